@@ -0,0 +1,43 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Replace the content of a file atomically, keeping its mode. New files are
+// created with mode 0644.
+func WriteFile(fname string, data []byte) error {
+	var mode os.FileMode = 0644
+	st, err := os.Stat(fname)
+	if err == nil {
+		mode = st.Mode()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+
+	err = f.Chmod(mode)
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), fname)
+}
@@ -0,0 +1,217 @@
+package headedit
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/net/html"
+	"io"
+	"sort"
+	"strings"
+)
+
+var ErrNoHead = errors.New("No <head> in document, not a HTML page")
+
+type token struct {
+	html.Token
+	raw []byte
+}
+
+func tokenize(data []byte) ([]token, error) {
+	var res []token
+	z := html.NewTokenizer(bytes.NewReader(data))
+	z.AllowCDATA(true)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			err := z.Err()
+			if err != io.EOF {
+				return nil, err
+			}
+			return res, nil
+		}
+		raw0 := z.Raw()
+		raw := make([]byte, len(raw0))
+		copy(raw, raw0)
+		res = append(res, token{z.Token(), raw})
+	}
+}
+
+func isStartTag(t token, name string) bool {
+	return (t.Type == html.StartTagToken || t.Type == html.SelfClosingTagToken) && t.Data == name
+}
+
+// Return true if data is a complete HTML document (it has a doctype, an <html>
+// or a <head> element) and not a fragment
+func IsDocument(data []byte) bool {
+	toks, err := tokenize(data)
+	if err != nil {
+		return false
+	}
+	for _, t := range toks {
+		if t.Type == html.DoctypeToken || isStartTag(t, "html") || isStartTag(t, "head") {
+			return true
+		}
+	}
+	return false
+}
+
+// Indentation of the line, if the text ends with a line break followed by
+// blanks
+func lineIndent(text []byte) (string, bool) {
+	cr := bytes.LastIndexByte(text, '\n')
+	if cr < 0 {
+		return "", false
+	}
+	indent := string(text[cr+1:])
+	if strings.Trim(indent, " \t") != "" {
+		return "", false
+	}
+	return indent, true
+}
+
+// Indentation unit guessed from the indentation of the parent
+func indentUnit(parent string) string {
+	if parent == "" || strings.Contains(parent, "\t") {
+		return "\t"
+	}
+	return parent
+}
+
+// Remove the trailing blanks and line break
+func trimLine(text []byte) []byte {
+	text = bytes.TrimRight(text, " \t")
+	if len(text) > 0 && text[len(text)-1] == '\n' {
+		text = text[:len(text)-1]
+		if len(text) > 0 && text[len(text)-1] == '\r' {
+			text = text[:len(text)-1]
+		}
+	}
+	return text
+}
+
+// Rewrite the group of head elements matched by group so it contains exactly
+// elements (serialized void elements such as <link /> or <meta />). The
+// existing elements of the group are removed and elements are inserted sorted,
+// one per line, at the place of the first element of the group or at the end
+// of the head. The indentation is taken from the other head children. The
+// head is created if implied. The document is unchanged if the group is
+// already up to date.
+func Update(data []byte, group func(t *html.Token) bool, elements []string) ([]byte, error) {
+	toks, err := tokenize(data)
+	if err != nil {
+		return nil, err
+	}
+
+	elements = append([]string(nil), elements...)
+	sort.Strings(elements)
+	for i := 1; i < len(elements); i++ {
+		if elements[i] == elements[i-1] {
+			elements = append(elements[:i], elements[i+1:]...)
+			i--
+		}
+	}
+
+	headStart, headEnd, htmlStart, doctype := -1, -1, -1, -1
+	for i, t := range toks {
+		if t.Type == html.DoctypeToken && doctype < 0 {
+			doctype = i
+		} else if isStartTag(t, "html") && htmlStart < 0 {
+			htmlStart = i
+		} else if t.Type == html.StartTagToken && t.Data == "head" && headStart < 0 {
+			headStart = i
+		} else if t.Type == html.EndTagToken && t.Data == "head" && headStart >= 0 {
+			headEnd = i
+			break
+		}
+	}
+
+	// indentation of the element at i and of its first child
+	indents := func(i int) (indent, child string) {
+		if i > 0 && toks[i-1].Type == html.TextToken {
+			indent, _ = lineIndent(toks[i-1].raw)
+		}
+		for j := i + 1; j < len(toks); j++ {
+			if toks[j].Type == html.EndTagToken && toks[j].Data == toks[i].Data {
+				break
+			}
+			if toks[j].Type != html.StartTagToken && toks[j].Type != html.SelfClosingTagToken {
+				continue
+			}
+			if toks[j-1].Type == html.TextToken {
+				if ind, ok := lineIndent(toks[j-1].raw); ok {
+					return indent, ind
+				}
+			}
+		}
+		return indent, indent + indentUnit(indent)
+	}
+
+	block := func(indent string) []byte {
+		var res []byte
+		for _, e := range elements {
+			res = append(res, '\n')
+			res = append(res, indent...)
+			res = append(res, e...)
+		}
+		return res
+	}
+
+	var out []byte
+
+	if headStart < 0 || headEnd < 0 {
+		if len(elements) == 0 {
+			return data, nil
+		}
+		at := htmlStart
+		if at < 0 {
+			at = doctype
+		}
+		if at < 0 {
+			return nil, ErrNoHead
+		}
+
+		var indent string
+		if at == htmlStart {
+			_, indent = indents(htmlStart)
+		}
+		child := indent + indentUnit(indent)
+		for i, t := range toks {
+			out = append(out, t.raw...)
+			if i == at {
+				out = append(out, '\n')
+				out = append(out, indent...)
+				out = append(out, "<head>"...)
+				out = append(out, block(child)...)
+				out = append(out, '\n')
+				out = append(out, indent...)
+				out = append(out, "</head>"...)
+			}
+		}
+		return out, nil
+	}
+
+	indent, child := indents(headStart)
+	insert := -1
+	for i, t := range toks {
+		if i > headStart && i < headEnd && (t.Type == html.StartTagToken || t.Type == html.SelfClosingTagToken) && group(&t.Token) {
+			out = trimLine(out)
+			if insert < 0 {
+				insert = len(out)
+			}
+			continue
+		}
+		if i == headEnd {
+			if insert < 0 {
+				insert = len(bytes.TrimRight(out, " \t\r\n"))
+			}
+			b := block(child)
+			if !bytes.Contains(out[insert:], []byte("\n")) && len(elements) > 0 {
+				b = append(b, '\n')
+				b = append(b, indent...)
+			}
+			out = append(out[:insert], append(b, out[insert:]...)...)
+		}
+		out = append(out, t.raw...)
+	}
+	return out, nil
+}
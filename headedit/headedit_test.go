@@ -0,0 +1,83 @@
+package headedit
+
+import (
+	"golang.org/x/net/html"
+	"testing"
+)
+
+func isLink(t *html.Token) bool {
+	return t.Data == "link"
+}
+
+func TestUpdate(t *testing.T) {
+	a := `<link rel="a" href="a.html" />`
+	b := `<link rel="b" href="b.html" />`
+	tests := []struct {
+		name     string
+		in       string
+		elements []string
+		want     string
+	}{
+		{"empty head", "<html>\n<head>\n</head>\n</html>\n", []string{b, a},
+			"<html>\n<head>\n\t" + a + "\n\t" + b + "\n</head>\n</html>\n"},
+		{"indent from children", "<html>\n  <head>\n    <title>T</title>\n  </head>\n</html>\n", []string{a},
+			"<html>\n  <head>\n    <title>T</title>\n    " + a + "\n  </head>\n</html>\n"},
+		{"replace group", "<html>\n  <head>\n    <link rel=\"x\" href=\"x.html\">\n    <title>T</title>\n  </head>\n</html>\n", []string{a},
+			"<html>\n  <head>\n    " + a + "\n    <title>T</title>\n  </head>\n</html>\n"},
+		{"remove group", "<html>\n  <head>\n    <title>T</title>\n    " + a + "\n  </head>\n</html>\n", nil,
+			"<html>\n  <head>\n    <title>T</title>\n  </head>\n</html>\n"},
+		{"duplicates", "<html><head></head></html>", []string{a, a},
+			"<html><head>\n\t" + a + "\n</head></html>"},
+		{"bom", "\xef\xbb\xbf<!DOCTYPE html>\n<html>\n<head>\n</head>\n</html>\n", []string{a},
+			"\xef\xbb\xbf<!DOCTYPE html>\n<html>\n<head>\n\t" + a + "\n</head>\n</html>\n"},
+		{"leading comment", "<!-- <head> -->\n<html>\n<head>\n</head>\n</html>\n", []string{a},
+			"<!-- <head> -->\n<html>\n<head>\n\t" + a + "\n</head>\n</html>\n"},
+		{"implied head", "<!DOCTYPE html>\n<html>\n  <body></body>\n</html>\n", []string{a},
+			"<!DOCTYPE html>\n<html>\n  <head>\n    " + a + "\n  </head>\n  <body></body>\n</html>\n"},
+		{"implied head without html", "<!DOCTYPE html>\n<title>T</title>\n", []string{a},
+			"<!DOCTYPE html>\n<head>\n\t" + a + "\n</head>\n<title>T</title>\n"},
+		{"implied head unchanged", "<!DOCTYPE html>\n<p>text</p>\n", nil,
+			"<!DOCTYPE html>\n<p>text</p>\n"},
+	}
+	for _, test := range tests {
+		got, err := Update([]byte(test.in), isLink, test.elements)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s:\n%q\nwant:\n%q", test.name, got, test.want)
+			continue
+		}
+		again, err := Update(got, isLink, test.elements)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if string(again) != string(got) {
+			t.Errorf("%s: not idempotent:\n%q\nthen:\n%q", test.name, got, again)
+		}
+	}
+}
+
+func TestUpdateNoHead(t *testing.T) {
+	_, err := Update([]byte("<p>fragment</p>"), isLink, []string{"<link />"})
+	if err != ErrNoHead {
+		t.Errorf("Update on a fragment: %v, want ErrNoHead", err)
+	}
+}
+
+func TestIsDocument(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"<!DOCTYPE html><p>a</p>", true},
+		{"\xef\xbb\xbf<html></html>", true},
+		{"<!-- c --><head></head>", true},
+		{"<p>fragment</p>", false},
+	}
+	for _, test := range tests {
+		if got := IsDocument([]byte(test.in)); got != test.want {
+			t.Errorf("IsDocument(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
@@ -7,7 +7,11 @@ import (
 	"golang.org/x/net/html"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -45,8 +49,34 @@ func main() {
 	os.Exit(0)
 }
 
+// Attributes of <backlink-list> not copied to <template-instance>
+var listAttrs = map[string]bool{
+	"rel":           true,
+	"rev":           true,
+	"src":           true,
+	"id":            true,
+	"sort":          true,
+	"order":         true,
+	"limit":         true,
+	"offset":        true,
+	"group-by":      true,
+	"group-length":  true,
+	"group-heading": true,
+}
+
+var elementNameRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+
+// A link matched by a <backlink-list>
+type backlink struct {
+	link  *html.Token
+	href  string
+	group string
+	key   string
+}
+
 func handleTags(curdir string, f1 io.Reader, f2 io.Writer) error {
 	var links []*html.Token
+	docs := map[string]*docInfo{}
 	p := parser.NewParser(f1)
 	for {
 
@@ -69,14 +99,35 @@ func handleTags(curdir string, f1 io.Reader, f2 io.Writer) error {
 			rel := p.Attr("rel")
 			rev := p.Attr("rev")
 			attrs := p.Token().Attr
-			//fmt.Fprintf(os.Stderr, "%d attributes: %#v\n", len(attrs), string(p.Raw()))
-			//fmt.Fprintf(os.Stderr, "%d attributes: %#v\n", len(attrs), p.Token())
+			sortKey := p.AttrVal("sort", "")
+			order := p.AttrVal("order", "asc")
+			groupBy := p.AttrVal("group-by", "")
+			groupHeading := p.AttrVal("group-heading", "")
+			limit, err := intAttr(p, "limit", -1)
+			if err != nil {
+				return err
+			}
+			offset, err := intAttr(p, "offset", 0)
+			if err != nil {
+				return err
+			}
+			groupLength, err := intAttr(p, "group-length", -1)
+			if err != nil {
+				return err
+			}
+			if order != "asc" && order != "desc" {
+				return fmt.Errorf("Invalid <backlink-list order=%#v>, expected asc or desc", order)
+			}
+			if groupHeading != "" && !elementNameRe.MatchString(groupHeading) {
+				return fmt.Errorf("Invalid <backlink-list group-heading=%#v>, expected an element name", groupHeading)
+			}
 
-			data, err := p.RawContent()
+			data, empty, err := readContent(p)
 			if err != nil {
 				return err
 			}
 
+			var matches []*backlink
 			//fmt.Fprintf(os.Stderr, "%d links\n", len(links))
 			for _, l := range links {
 				//fmt.Fprintf(os.Stderr, "link: %v\n", l.String())
@@ -84,24 +135,92 @@ func handleTags(curdir string, f1 io.Reader, f2 io.Writer) error {
 				href := parser.Attr(l, "href")
 				rel2 := parser.Attr(l, "rel")
 				rev2 := parser.Attr(l, "rev")
-				if rel != nil && (rel2 == nil || rel.Val != rel2.Val) {
+				if rel != nil && !matchTokens(rel.Val, rel2) {
 					continue
 				}
-				if rev != nil && (rev2 == nil || rev.Val != rev2.Val) {
+				if rev != nil && !matchTokens(rev.Val, rev2) {
 					continue
 				}
 				if href == nil {
 					continue
 				}
 
+				b := &backlink{link: l, href: href.Val}
+				if sortKey != "" {
+					b.key, err = linkValue(curdir, docs, b, sortKey)
+					if err != nil {
+						return err
+					}
+				}
+				if groupBy != "" {
+					b.group, err = linkValue(curdir, docs, b, groupBy)
+					if err != nil {
+						return err
+					}
+					if groupLength >= 0 && groupLength < len(b.group) {
+						b.group = b.group[:groupLength]
+					}
+				}
+				matches = append(matches, b)
+			}
+
+			if sortKey != "" {
+				sort.SliceStable(matches, func(i, j int) bool {
+					if order == "desc" {
+						return matches[i].key > matches[j].key
+					}
+					return matches[i].key < matches[j].key
+				})
+			} else if order == "desc" {
+				for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+					matches[i], matches[j] = matches[j], matches[i]
+				}
+			}
+			if groupBy != "" {
+				// keep the groups contiguous, in the same order as the items
+				sort.SliceStable(matches, func(i, j int) bool {
+					if order == "desc" {
+						return matches[i].group > matches[j].group
+					}
+					return matches[i].group < matches[j].group
+				})
+			}
+
+			if offset > len(matches) {
+				offset = len(matches)
+			}
+			matches = matches[offset:]
+			if limit >= 0 && limit < len(matches) {
+				matches = matches[:limit]
+			}
+
+			if len(matches) == 0 {
+				raw = empty
+			}
+
+			for i, b := range matches {
+				if groupBy != "" && (i == 0 || matches[i-1].group != b.group) {
+					if i > 0 {
+						raw = append(raw, []byte("</div>")...)
+					}
+					raw = append(raw, []byte("<div class=\"backlink-group\" data-group=\"")...)
+					raw = append(raw, []byte(html.EscapeString(b.group))...)
+					raw = append(raw, []byte("\">")...)
+					if groupHeading != "" {
+						raw = append(raw, []byte("<"+groupHeading+">")...)
+						raw = append(raw, []byte(html.EscapeString(b.group))...)
+						raw = append(raw, []byte("</"+groupHeading+">")...)
+					}
+				}
+
 				raw = append(raw, []byte("<template-instance src=\"")...)
-				raw = append(raw, []byte(html.EscapeString(href.Val))...)
+				raw = append(raw, []byte(html.EscapeString(b.href))...)
 				raw = append(raw, '"')
 
 				//fmt.Fprintf(os.Stderr, "%d attributes:\n", len(attrs))
 				for _, a := range attrs {
 					//fmt.Fprintf(os.Stderr, " - %#v\n", a)
-					if a.Key == "rel" || a.Key == "rev" || a.Key == "src" || a.Key == "id" {
+					if listAttrs[a.Key] {
 						continue
 					}
 					key := a.Key
@@ -117,6 +236,9 @@ func handleTags(curdir string, f1 io.Reader, f2 io.Writer) error {
 				raw = append(raw, data...)
 				raw = append(raw, []byte("</template-instance>")...)
 			}
+			if groupBy != "" && len(matches) > 0 {
+				raw = append(raw, []byte("</div>")...)
+			}
 
 		}
 
@@ -129,3 +251,142 @@ func handleTags(curdir string, f1 io.Reader, f2 io.Writer) error {
 
 	}
 }
+
+// Return true if one of the space separated tokens of the link attribute
+// matches one of the space separated glob patterns (e.g. "tag series" or
+// "pagination.page.num.*")
+func matchTokens(patterns string, attr *html.Attribute) bool {
+	if attr == nil {
+		return false
+	}
+	for _, pattern := range strings.Fields(patterns) {
+		for _, tok := range strings.Fields(attr.Val) {
+			if ok, err := path.Match(pattern, tok); ok || (err != nil && pattern == tok) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func intAttr(p *parser.Parser, name string, defval int) (int, error) {
+	val := p.AttrVal(name, "")
+	if val == "" {
+		return defval, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid <backlink-list %s=%#v>, expected a positive number", name, val)
+	}
+	return n, nil
+}
+
+// Read the content of <backlink-list>, the <empty> child is returned
+// separately
+func readContent(p *parser.Parser) (data, empty []byte, err error) {
+	var depth int = p.Depth()
+
+	for {
+		err := p.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if p.Type() == html.StartTagToken && p.Data() == "empty" && p.Depth() == depth+1 {
+			empty, err = p.RawContent()
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		err = p.End()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if depth > p.Depth() {
+			return data, empty, nil
+		}
+
+		data = append(data, p.Raw()...)
+	}
+}
+
+// Title and <meta> of a linked document
+type docInfo struct {
+	title string
+	meta  map[string]string
+}
+
+func readDocInfo(fname string) (*docInfo, error) {
+	info := &docInfo{meta: map[string]string{}}
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "%s: not found, no value to sort by\n", fname)
+		return info, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := parser.NewParser(f)
+	for {
+		err := p.Next()
+		if err == io.EOF {
+			return info, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if p.Type() == html.StartTagToken && p.Data() == "title" && info.title == "" {
+			title, err := p.TextContent()
+			if err != nil {
+				return nil, err
+			}
+			info.title = strings.TrimSpace(string(title))
+		} else if p.IsStartTag() && p.Data() == "meta" {
+			name := p.AttrVal("name", p.AttrVal("property", ""))
+			if _, exists := info.meta[name]; name != "" && !exists {
+				info.meta[name] = p.AttrVal("content", "")
+			}
+		} else if p.IsEndTag() && p.Data() == "head" {
+			return info, nil
+		}
+	}
+}
+
+// Value used to sort or group a link: title (the link title or the linked
+// document title), href or meta:NAME (the <meta name=NAME> content of the
+// linked document)
+func linkValue(curdir string, docs map[string]*docInfo, b *backlink, key string) (string, error) {
+	if key == "href" {
+		return b.href, nil
+	} else if key == "title" {
+		if title := parser.Attr(b.link, "title"); title != nil {
+			return title.Val, nil
+		}
+	} else if !strings.HasPrefix(key, "meta:") {
+		return "", fmt.Errorf("Invalid <backlink-list> key %#v, expected title, href or meta:NAME", key)
+	}
+
+	fname := b.href
+	if i := strings.IndexAny(fname, "?#"); i >= 0 {
+		fname = fname[:i]
+	}
+	fname = filepath.Join(curdir, fname)
+	doc := docs[fname]
+	if doc == nil {
+		var err error
+		doc, err = readDocInfo(fname)
+		if err != nil {
+			return "", err
+		}
+		docs[fname] = doc
+	}
+
+	if key == "title" {
+		return doc.title, nil
+	}
+	return doc.meta[strings.TrimPrefix(key, "meta:")], nil
+}
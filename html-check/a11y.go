@@ -0,0 +1,474 @@
+package main
+
+import (
+	"golang.org/x/net/html"
+	"sort"
+	"strings"
+)
+
+// Accessibility rules, references are WCAG 2.1 success criteria
+
+func init() {
+	Rules = append(Rules,
+		&Rule{
+			Id:          "form-label",
+			Group:       "a11y",
+			Severity:    SeverityWarning,
+			Description: "Form control without label",
+			WCAG:        []string{"1.3.1", "3.3.2", "4.1.2"},
+			New:         func(r ReportFunc) RuleCheck { return &formLabelCheck{report: r, labels: map[string]bool{}} },
+		},
+		&Rule{
+			Id:          "landmark-unique",
+			Group:       "a11y",
+			Severity:    SeverityWarning,
+			Description: "Landmark role repeated without distinct label",
+			WCAG:        []string{"1.3.1", "2.4.1"},
+			New:         func(r ReportFunc) RuleCheck { return &landmarkCheck{report: r} },
+		},
+		&Rule{
+			Id:          "aria-valid",
+			Group:       "a11y",
+			Severity:    SeverityError,
+			Description: "Unknown ARIA role or attribute, or attribute not allowed on the role",
+			WCAG:        []string{"4.1.2"},
+			New:         func(r ReportFunc) RuleCheck { return &ariaCheck{report: r} },
+		},
+		&Rule{
+			Id:          "table-header",
+			Group:       "a11y",
+			Severity:    SeverityWarning,
+			Description: "Data table without header cells",
+			WCAG:        []string{"1.3.1"},
+			New:         func(r ReportFunc) RuleCheck { return &tableHeaderCheck{report: r} },
+		})
+}
+
+// Pages of the WCAG 2.1 understanding documents
+var wcagUnderstanding = map[string]string{
+	"1.1.1": "non-text-content",
+	"1.3.1": "info-and-relationships",
+	"2.4.1": "bypass-blocks",
+	"2.4.4": "link-purpose-in-context",
+	"3.1.1": "language-of-page",
+	"3.3.2": "labels-or-instructions",
+	"4.1.2": "name-role-value",
+}
+
+func wcagURL(sc string) string {
+	if page, ok := wcagUnderstanding[sc]; ok {
+		return "https://www.w3.org/WAI/WCAG21/Understanding/" + page + ".html"
+	}
+	return ""
+}
+
+// Return true if the element has an accessible name given by attributes
+func hasLabelAttr(t html.Token) bool {
+	for _, name := range []string{"aria-label", "aria-labelledby", "title"} {
+		if val, _ := tokenAttr(t, name); strings.TrimSpace(val) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+type formControl struct {
+	pos Position
+	tag string
+	id  string
+}
+
+// Controls are labelled by a <label for>, an enclosing <label> or attributes.
+// Labels can come after the control, check at the end of the document.
+type formLabelCheck struct {
+	baseCheck
+	report    ReportFunc
+	controls  []formControl
+	labels    map[string]bool
+	labelOpen int // depth of the open <label>, 0 if none
+}
+
+func (c *formLabelCheck) StartTag(ctx *Context, t html.Token) {
+	if t.Data == "label" {
+		if c.labelOpen == 0 && t.Type == html.StartTagToken {
+			c.labelOpen = len(ctx.Breadcrumb)
+		}
+		if id, ok := tokenAttr(t, "for"); ok {
+			c.labels[id] = true
+		}
+		return
+	}
+	if t.Data != "input" && t.Data != "select" && t.Data != "textarea" {
+		return
+	}
+	switch typ, _ := tokenAttr(t, "type"); typ {
+	case "hidden", "submit", "reset", "button", "image":
+		return
+	}
+	if c.labelOpen > 0 || hasLabelAttr(t) {
+		return
+	}
+	id, _ := tokenAttr(t, "id")
+	c.controls = append(c.controls, formControl{ctx.Pos, t.Data, id})
+}
+
+func (c *formLabelCheck) EndTag(ctx *Context, t html.Token) {
+	if t.Data == "label" && len(ctx.Breadcrumb) == c.labelOpen {
+		c.labelOpen = 0
+	}
+}
+
+func (c *formLabelCheck) EndDocument(ctx *Context) {
+	for _, ctl := range c.controls {
+		if ctl.id == "" || !c.labels[ctl.id] {
+			c.report(ctl.pos, "<%s> without label", ctl.tag)
+		}
+	}
+}
+
+type landmark struct {
+	pos   Position
+	label string
+}
+
+// Landmarks that must appear at most once per page
+var uniqueLandmarks = map[string]bool{
+	"main":        true,
+	"banner":      true,
+	"contentinfo": true,
+}
+
+// Sectioning elements in which <header> and <footer> are not landmarks
+var sectioningElements = map[string]bool{
+	"article": true,
+	"aside":   true,
+	"main":    true,
+	"nav":     true,
+	"section": true,
+}
+
+type landmarkCheck struct {
+	baseCheck
+	report    ReportFunc
+	landmarks map[string][]landmark
+}
+
+func (c *landmarkCheck) StartTag(ctx *Context, t html.Token) {
+	role, _ := tokenAttr(t, "role")
+	if role == "" {
+		switch t.Data {
+		case "main":
+			role = "main"
+		case "nav":
+			role = "navigation"
+		case "aside":
+			role = "complementary"
+		case "header", "footer":
+			for _, e := range ctx.Breadcrumb[:len(ctx.Breadcrumb)-1] {
+				if sectioningElements[e] {
+					return
+				}
+			}
+			role = "banner"
+			if t.Data == "footer" {
+				role = "contentinfo"
+			}
+		case "section", "form":
+			// landmarks only when labelled
+			if hasLabelAttr(t) {
+				role = "region"
+				if t.Data == "form" {
+					role = "form"
+				}
+			}
+		}
+	}
+	switch role {
+	case "main", "banner", "contentinfo", "navigation", "complementary", "region", "form", "search":
+	default:
+		return
+	}
+	label, _ := tokenAttr(t, "aria-label")
+	if label == "" {
+		label, _ = tokenAttr(t, "aria-labelledby")
+	}
+	if c.landmarks == nil {
+		c.landmarks = map[string][]landmark{}
+	}
+	c.landmarks[role] = append(c.landmarks[role], landmark{ctx.Pos, strings.TrimSpace(label)})
+}
+
+func (c *landmarkCheck) EndDocument(ctx *Context) {
+	var roles []string
+	for role := range c.landmarks {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		landmarks := c.landmarks[role]
+		if len(landmarks) < 2 {
+			continue
+		}
+		if uniqueLandmarks[role] {
+			for _, l := range landmarks[1:] {
+				c.report(l.pos, "More than one %s landmark", role)
+			}
+			continue
+		}
+		labels := map[string]bool{}
+		for _, l := range landmarks {
+			if l.label == "" || labels[l.label] {
+				c.report(l.pos, "Landmark %s is not unique, give it a distinct aria-label", role)
+			}
+			labels[l.label] = true
+		}
+	}
+}
+
+// WAI-ARIA 1.1 roles, and meter from WAI-ARIA 1.2
+var ariaRoles = map[string]bool{}
+
+func init() {
+	for _, role := range strings.Fields(`alert alertdialog application article
+		banner button cell checkbox columnheader combobox complementary
+		contentinfo definition dialog directory document feed figure form grid
+		gridcell group heading img link list listbox listitem log main marquee
+		math menu menubar menuitem menuitemcheckbox menuitemradio meter navigation none
+		note option presentation progressbar radio radiogroup region row
+		rowgroup rowheader scrollbar search searchbox separator slider
+		spinbutton status switch tab table tablist tabpanel term textbox timer
+		toolbar tooltip tree treegrid treeitem`) {
+		ariaRoles[role] = true
+	}
+}
+
+// ARIA attributes allowed on any role
+var ariaGlobalAttrs = map[string]bool{
+	"aria-atomic":          true,
+	"aria-busy":            true,
+	"aria-controls":        true,
+	"aria-current":         true,
+	"aria-describedby":     true,
+	"aria-details":         true,
+	"aria-disabled":        true,
+	"aria-dropeffect":      true,
+	"aria-errormessage":    true,
+	"aria-flowto":          true,
+	"aria-grabbed":         true,
+	"aria-haspopup":        true,
+	"aria-hidden":          true,
+	"aria-invalid":         true,
+	"aria-keyshortcuts":    true,
+	"aria-label":           true,
+	"aria-labelledby":      true,
+	"aria-live":            true,
+	"aria-owns":            true,
+	"aria-relevant":        true,
+	"aria-roledescription": true,
+}
+
+// ARIA attributes only allowed on some roles
+var ariaRoleAttrs = map[string][]string{
+	"aria-activedescendant": {"application", "combobox", "grid", "group", "listbox", "menu", "menubar", "radiogroup", "row", "searchbox", "spinbutton", "tablist", "textbox", "toolbar", "tree", "treegrid"},
+	"aria-autocomplete":     {"combobox", "searchbox", "textbox"},
+	"aria-checked":          {"checkbox", "menuitemcheckbox", "menuitemradio", "option", "radio", "switch", "treeitem"},
+	"aria-colcount":         {"grid", "table", "treegrid"},
+	"aria-colindex":         {"cell", "columnheader", "gridcell", "row", "rowheader"},
+	"aria-colspan":          {"cell", "columnheader", "gridcell", "rowheader"},
+	"aria-expanded":         {"application", "button", "checkbox", "combobox", "gridcell", "link", "listbox", "menuitem", "row", "rowheader", "tab", "treeitem"},
+	"aria-level":            {"grid", "heading", "listitem", "row", "tablist", "treegrid", "treeitem"},
+	"aria-modal":            {"alertdialog", "dialog"},
+	"aria-multiline":        {"searchbox", "textbox"},
+	"aria-multiselectable":  {"grid", "listbox", "tablist", "tree", "treegrid"},
+	"aria-orientation":      {"listbox", "menu", "menubar", "radiogroup", "scrollbar", "separator", "slider", "tablist", "toolbar", "tree", "treegrid"},
+	"aria-placeholder":      {"searchbox", "textbox"},
+	"aria-posinset":         {"article", "listitem", "menuitem", "menuitemcheckbox", "menuitemradio", "option", "radio", "row", "tab", "treeitem"},
+	"aria-pressed":          {"button"},
+	"aria-readonly":         {"checkbox", "combobox", "grid", "gridcell", "listbox", "radiogroup", "slider", "spinbutton", "searchbox", "textbox", "treegrid"},
+	"aria-required":         {"checkbox", "combobox", "gridcell", "listbox", "radiogroup", "spinbutton", "searchbox", "textbox", "tree", "treegrid"},
+	"aria-rowcount":         {"grid", "table", "treegrid"},
+	"aria-rowindex":         {"cell", "columnheader", "gridcell", "row", "rowheader"},
+	"aria-rowspan":          {"cell", "columnheader", "gridcell", "rowheader"},
+	"aria-selected":         {"columnheader", "gridcell", "option", "row", "rowheader", "tab", "treeitem"},
+	"aria-setsize":          {"article", "listitem", "menuitem", "menuitemcheckbox", "menuitemradio", "option", "radio", "row", "tab", "treeitem"},
+	"aria-sort":             {"columnheader", "rowheader"},
+	"aria-valuemax":         {"meter", "progressbar", "scrollbar", "separator", "slider", "spinbutton"},
+	"aria-valuemin":         {"meter", "progressbar", "scrollbar", "separator", "slider", "spinbutton"},
+	"aria-valuenow":         {"meter", "progressbar", "scrollbar", "separator", "slider", "spinbutton"},
+	"aria-valuetext":        {"meter", "progressbar", "scrollbar", "separator", "slider", "spinbutton"},
+}
+
+// ARIA attributes required by roles used on elements without native
+// semantics
+var ariaRequiredAttrs = map[string][]string{
+	"checkbox":         {"aria-checked"},
+	"combobox":         {"aria-expanded"},
+	"heading":          {"aria-level"},
+	"menuitemcheckbox": {"aria-checked"},
+	"menuitemradio":    {"aria-checked"},
+	"radio":            {"aria-checked"},
+	"scrollbar":        {"aria-controls", "aria-valuenow"},
+	"slider":           {"aria-valuenow"},
+	"switch":           {"aria-checked"},
+}
+
+// Role of the element when no role attribute is given
+func implicitRole(t html.Token) string {
+	switch t.Data {
+	case "a", "area":
+		if _, ok := tokenAttr(t, "href"); ok {
+			return "link"
+		}
+	case "article", "button", "dialog", "form", "main", "math", "table":
+		return t.Data
+	case "aside":
+		return "complementary"
+	case "footer":
+		return "contentinfo"
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		return "heading"
+	case "header":
+		return "banner"
+	case "hr":
+		return "separator"
+	case "img":
+		return "img"
+	case "input":
+		switch typ, _ := tokenAttr(t, "type"); typ {
+		case "checkbox":
+			return "checkbox"
+		case "radio":
+			return "radio"
+		case "range":
+			return "slider"
+		case "number":
+			return "spinbutton"
+		case "search":
+			return "searchbox"
+		case "button", "submit", "reset", "image":
+			return "button"
+		default:
+			return "textbox"
+		}
+	case "li":
+		return "listitem"
+	case "meter":
+		return "meter"
+	case "nav":
+		return "navigation"
+	case "ol", "ul":
+		return "list"
+	case "option":
+		return "option"
+	case "progress":
+		return "progressbar"
+	case "section":
+		return "region"
+	case "select":
+		return "listbox"
+	case "tbody", "tfoot", "thead":
+		return "rowgroup"
+	case "td":
+		return "cell"
+	case "textarea":
+		return "textbox"
+	case "th":
+		return "columnheader"
+	case "tr":
+		return "row"
+	}
+	return ""
+}
+
+type ariaCheck struct {
+	baseCheck
+	report ReportFunc
+}
+
+func (c *ariaCheck) StartTag(ctx *Context, t html.Token) {
+	role, explicit := tokenAttr(t, "role")
+	if explicit {
+		// The first known role of the list is used
+		roles := strings.Fields(role)
+		role = ""
+		for _, r := range roles {
+			if ariaRoles[r] {
+				role = r
+				break
+			}
+		}
+		if role == "" {
+			c.report(ctx.Pos, "Unknown ARIA role %#v on <%s>", strings.Join(roles, " "), t.Data)
+			return
+		}
+	} else {
+		role = implicitRole(t)
+	}
+
+	for _, a := range t.Attr {
+		if !strings.HasPrefix(a.Key, "aria-") || ariaGlobalAttrs[a.Key] {
+			continue
+		}
+		allowed, known := ariaRoleAttrs[a.Key]
+		if !known {
+			c.report(ctx.Pos, "Unknown ARIA attribute %s on <%s>", a.Key, t.Data)
+			continue
+		}
+		ok := false
+		for _, r := range allowed {
+			ok = ok || r == role
+		}
+		if !ok && role == "" {
+			c.report(ctx.Pos, "%s is not allowed on <%s> without role", a.Key, t.Data)
+		} else if !ok {
+			c.report(ctx.Pos, "%s is not allowed on role %s", a.Key, role)
+		}
+	}
+
+	if !explicit || implicitRole(t) == role {
+		return
+	}
+	for _, required := range ariaRequiredAttrs[role] {
+		if _, ok := tokenAttr(t, required); !ok {
+			c.report(ctx.Pos, "Role %s requires %s", role, required)
+		}
+	}
+}
+
+type openTable struct {
+	pos     Position
+	depth   int
+	headers bool
+	layout  bool
+}
+
+// Tables with role presentation or none are layout tables and are not checked
+type tableHeaderCheck struct {
+	baseCheck
+	report ReportFunc
+	tables []openTable
+}
+
+func (c *tableHeaderCheck) StartTag(ctx *Context, t html.Token) {
+	role, _ := tokenAttr(t, "role")
+	if t.Data == "table" {
+		c.tables = append(c.tables, openTable{
+			pos:    ctx.Pos,
+			depth:  len(ctx.Breadcrumb),
+			layout: role == "presentation" || role == "none",
+		})
+	} else if len(c.tables) > 0 && (t.Data == "th" || role == "columnheader" || role == "rowheader") {
+		c.tables[len(c.tables)-1].headers = true
+	}
+}
+
+func (c *tableHeaderCheck) EndTag(ctx *Context, t html.Token) {
+	if t.Data != "table" || len(c.tables) == 0 || c.tables[len(c.tables)-1].depth != len(ctx.Breadcrumb) {
+		return
+	}
+	table := c.tables[len(c.tables)-1]
+	c.tables = c.tables[:len(c.tables)-1]
+	if !table.headers && !table.layout {
+		c.report(table.pos, "Table without header cells, use <th> or role=\"presentation\" for layout tables")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+	SeverityNone // never reached, used to never fail
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return "none"
+	}
+}
+
+func ParseSeverity(s string) (Severity, error) {
+	switch s {
+	case "info":
+		return SeverityInfo, nil
+	case "warning":
+		return SeverityWarning, nil
+	case "error":
+		return SeverityError, nil
+	case "none":
+		return SeverityNone, nil
+	default:
+		return SeverityNone, fmt.Errorf("Unknown severity %#v", s)
+	}
+}
+
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// SARIF level corresponding to the severity
+func (s Severity) sarifLevel() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+type Diagnostic struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	File     string   `json:"file"`
+	Line     int      `json:"line"`
+	Column   int      `json:"column"`
+	Message  string   `json:"message"`
+	WCAG     []string `json:"wcag,omitempty"`
+}
+
+func (d Diagnostic) String() string {
+	rule := d.Rule
+	if len(d.WCAG) > 0 {
+		rule += ", WCAG " + strings.Join(d.WCAG, " ")
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s [%s]", d.File, d.Line, d.Column, d.Severity, d.Message, rule)
+}
+
+type Reporter interface {
+	Report(d Diagnostic) error
+	Close() error
+}
+
+func NewReporter(format string, w io.Writer) (Reporter, error) {
+	switch format {
+	case "text":
+		return &textReporter{w}, nil
+	case "json":
+		return &jsonReporter{json.NewEncoder(w)}, nil
+	case "sarif":
+		return &sarifReporter{w: w}, nil
+	default:
+		return nil, fmt.Errorf("Unknown output format %#v", format)
+	}
+}
+
+type textReporter struct {
+	w io.Writer
+}
+
+func (r *textReporter) Report(d Diagnostic) error {
+	_, err := fmt.Fprintln(r.w, d.String())
+	return err
+}
+
+func (r *textReporter) Close() error {
+	return nil
+}
+
+// JSON lines, one diagnostic per line
+type jsonReporter struct {
+	enc *json.Encoder
+}
+
+func (r *jsonReporter) Report(d Diagnostic) error {
+	return r.enc.Encode(d)
+}
+
+func (r *jsonReporter) Close() error {
+	return nil
+}
+
+// SARIF 2.1.0, written as a whole when closed
+type sarifReporter struct {
+	w     io.Writer
+	diags []Diagnostic
+}
+
+func (r *sarifReporter) Report(d Diagnostic) error {
+	r.diags = append(r.diags, d)
+	return nil
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	Id         string               `json:"id"`
+	HelpURI    string               `json:"helpUri,omitempty"`
+	Properties *sarifRuleProperties `json:"properties,omitempty"`
+}
+
+type sarifRuleProperties struct {
+	Tags []string `json:"tags"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleId    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+}
+
+func (r *sarifReporter) Close() error {
+	run := sarifRun{
+		Tool:    sarifTool{sarifDriver{Name: "html-check", Rules: []sarifRule{}}},
+		Results: []sarifResult{},
+	}
+
+	rules := map[string]bool{}
+	for _, d := range r.diags {
+		if !rules[d.Rule] {
+			rules[d.Rule] = true
+			rule := sarifRule{Id: d.Rule}
+			if r := findRule(d.Rule); r != nil && r.Group != "" {
+				rule.Properties = &sarifRuleProperties{[]string{r.Group}}
+			}
+			for _, sc := range d.WCAG {
+				if rule.HelpURI == "" {
+					rule.HelpURI = wcagURL(sc)
+				}
+				if rule.Properties == nil {
+					rule.Properties = &sarifRuleProperties{}
+				}
+				rule.Properties.Tags = append(rule.Properties.Tags, "WCAG "+sc)
+			}
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, rule)
+		}
+		run.Results = append(run.Results, sarifResult{
+			RuleId:  d.Rule,
+			Level:   d.Severity.sarifLevel(),
+			Message: sarifMessage{d.Message},
+			Locations: []sarifLocation{{sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{filepath.ToSlash(d.File)},
+				Region:           sarifRegion{d.Line, d.Column},
+			}}},
+		})
+	}
+	sort.Slice(run.Tool.Driver.Rules, func(i, j int) bool {
+		return run.Tool.Driver.Rules[i].Id < run.Tool.Driver.Rules[j].Id
+	})
+
+	enc := json.NewEncoder(r.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{
+		Version: "2.1.0",
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Runs:    []sarifRun{run},
+	})
+}
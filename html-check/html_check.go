@@ -1,30 +1,198 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"github.com/mildred/htmltools/atomicfile"
+	"github.com/mildred/htmltools/udiff"
 	"golang.org/x/net/html"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 )
 
+var rootDir string = ""
+
 func main() {
+	root := flag.String("root", "", "Site root used to resolve absolute paths in links")
+	format := flag.String("format", "text", "Diagnostics format: text, json or sarif")
+	output := flag.String("o", "", "Write diagnostics to this file instead of stderr")
+	failOn := flag.String("fail-on", "error", "Minimum severity causing a non zero exit code: info, warning, error or none")
+	configFile := flag.String("config", "", "Rule configuration file")
+	enable := flag.String("enable", "", "Comma separated list of rules to enable")
+	disable := flag.String("disable", "", "Comma separated list of rules to disable")
+	listRules := flag.Bool("rules", false, "List the rules and exit")
+	fix := flag.Bool("fix", false, "Fix the document in place (or on stdout when reading stdin)")
+	diff := flag.Bool("diff", false, "Print the changes -fix would make as an unified diff")
+	jobs := flag.Int("j", runtime.NumCPU(), "Number of files checked concurrently")
 	flag.Parse()
-	infile := flag.Arg(0)
 
-	if infile == "-" {
-		infile = ""
+	rootDir = *root
+
+	if *listRules {
+		printRules(os.Stdout)
+		os.Exit(0)
+	}
+
+	config := Config{}
+	if *configFile != "" {
+		err := ReadConfigFile(*configFile, config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+	for _, list := range []struct{ rules, val string }{{*enable, "on"}, {*disable, "off"}} {
+		for _, id := range strings.Split(list.rules, ",") {
+			if id == "" {
+				continue
+			}
+			err := config.SetRule(strings.TrimSpace(id), list.val)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		}
+	}
+
+	failSeverity, err := ParseSeverity(*failOn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	var out io.Writer = os.Stderr
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	reporter, err := NewReporter(*format, out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+
+	files, entries, site, err := expandArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	results := checkFiles(files, *jobs, func(infile string) Result {
+		var data []byte
+		var err error
+		if infile == "" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(infile)
+		}
+		if err != nil {
+			return Result{Err: err}
+		}
+
+		var copyOut io.Writer = os.Stdout
+		var fixed io.Writer
+		var fixedData bytes.Buffer
+		if *fix || *diff {
+			copyOut = ioutil.Discard
+			fixed = &fixedData
+		} else if site {
+			copyOut = ioutil.Discard
+		}
+
+		diags, doc, err := handleTags(".", infile, bytes.NewReader(data), copyOut, fixed, config)
+		if err != nil {
+			return Result{Err: err}
+		}
+
+		var out bytes.Buffer
+		if *diff {
+			name := infile
+			if name == "" {
+				name = "-"
+			}
+			err = udiff.Unified(&out, name, name, data, fixedData.Bytes(), 3)
+		} else if *fix && infile == "" {
+			_, err = out.Write(fixedData.Bytes())
+		} else if *fix && !bytes.Equal(data, fixedData.Bytes()) {
+			err = atomicfile.WriteFile(infile, fixedData.Bytes())
+		}
+		return Result{diags, doc, out.Bytes(), err}
+	})
+
+	var diags []Diagnostic
+	var docs []*Document
+	failed := false
+	for i, res := range results {
+		if res.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", files[i], res.Err)
+			failed = true
+		}
+		if res.Doc != nil {
+			docs = append(docs, res.Doc)
+		}
+		diags = append(diags, res.Diags...)
+		_, err = os.Stdout.Write(res.Out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if site {
+		diags = append(diags, siteChecks(docs, entries)...)
 	}
 
-	err := handleTags(".", infile, os.Stdout)
+	errors := 0
+	for _, d := range diags {
+		if d.Severity >= failSeverity {
+			errors += 1
+		}
+		err = reporter.Report(d)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	err = reporter.Close()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 
+	if errors > 0 {
+		if *format == "text" {
+			if len(files) == 1 && files[0] != "" {
+				fmt.Fprintf(out, "%s: There are %d errors\n", files[0], errors)
+			} else {
+				fmt.Fprintf(out, "There are %d errors\n", errors)
+			}
+		}
+		os.Exit(1)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+
 	os.Exit(0)
 }
 
@@ -39,31 +207,193 @@ func readAttributeXmlBase(z *html.Tokenizer, attrs bool) (src string) {
 	return
 }
 
-func handleTags(curdir, infile string, f2 io.Writer) error {
-	var f1 io.Reader
+// Position of a token in the source document, lines and columns start at 1
+type Position struct {
+	Line int
+	Col  int
+}
+
+func (pos Position) String() string {
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Col)
+}
+
+// Return the position after data
+func (pos Position) Advance(data []byte) Position {
+	for _, c := range data {
+		if c == '\n' {
+			pos.Line += 1
+			pos.Col = 1
+		} else {
+			pos.Col += 1
+		}
+	}
+	return pos
+}
+
+// HTML elements that have no end tag
+var voidElements = map[string]bool{
+	"area":   true,
+	"base":   true,
+	"br":     true,
+	"col":    true,
+	"embed":  true,
+	"hr":     true,
+	"img":    true,
+	"input":  true,
+	"keygen": true,
+	"link":   true,
+	"meta":   true,
+	"param":  true,
+	"source": true,
+	"track":  true,
+	"wbr":    true,
+}
+
+// HTML elements whose end tag is optional, they are closed implicitly by some
+// start tags, by the end tag of an ancestor or by the end of the document
+var optionalEnd = map[string]bool{
+	"html": true, "head": true, "body": true,
+	"p": true, "li": true, "dt": true, "dd": true,
+	"option": true, "optgroup": true, "colgroup": true, "caption": true,
+	"thead": true, "tbody": true, "tfoot": true, "tr": true, "td": true, "th": true,
+	"rb": true, "rt": true, "rtc": true, "rp": true,
+}
+
+// Open elements closed by a start tag, when only elements with an optional
+// end tag are in between
+var closedBy = map[string][]string{
+	"li":       {"li"},
+	"dt":       {"dt", "dd"},
+	"dd":       {"dt", "dd"},
+	"option":   {"option"},
+	"optgroup": {"option", "optgroup"},
+	"tr":       {"tr", "td", "th"},
+	"td":       {"td", "th"},
+	"th":       {"td", "th"},
+	"thead":    {"thead", "tbody", "tfoot", "tr", "td", "th", "caption", "colgroup"},
+	"tbody":    {"thead", "tbody", "tfoot", "tr", "td", "th", "caption", "colgroup"},
+	"tfoot":    {"thead", "tbody", "tfoot", "tr", "td", "th", "caption", "colgroup"},
+	"rb":       {"rb", "rt", "rtc", "rp"},
+	"rt":       {"rb", "rt", "rp"},
+	"rtc":      {"rb", "rt", "rtc", "rp"},
+	"rp":       {"rb", "rt", "rp"},
+}
+
+// Start tags closing an open <p>
+var closesP = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"details": true, "div": true, "dl": true, "fieldset": true,
+	"figcaption": true, "figure": true, "footer": true, "form": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hgroup": true, "hr": true, "main": true, "menu": true,
+	"nav": true, "ol": true, "p": true, "pre": true, "section": true,
+	"table": true, "ul": true,
+}
+
+// Index of the first element of breadcrumb from start that needs an explicit
+// end tag when the elements from start are closed: the elements with an
+// optional end tag below it are closed implicitly, the ones above it must be
+// closed before it. len(breadcrumb) if all can be closed implicitly.
+func explicitEnds(breadcrumb []string, start int) int {
+	for i := start; i < len(breadcrumb); i++ {
+		if !optionalEnd[breadcrumb[i]] {
+			return i
+		}
+	}
+	return len(breadcrumb)
+}
+
+// Number of open elements at the top of breadcrumb implicitly closed by the
+// start tag of name
+func impliedEnds(breadcrumb []string, name string) int {
+	n := 0
+	closes := closedBy[name]
+	for i := len(breadcrumb) - 1; i >= 0 && optionalEnd[breadcrumb[i]]; i-- {
+		if breadcrumb[i] == "p" && closesP[name] && i == len(breadcrumb)-1 {
+			n = 1
+		}
+		for _, c := range closes {
+			if breadcrumb[i] == c {
+				n = len(breadcrumb) - i
+			}
+		}
+	}
+	return n
+}
+
+// Copy the document read from f1 to f2 and return the diagnostics and a
+// summary of the document. infile is the name of the document, empty for
+// stdin. If fixed is not nil, the document is also written there with missing
+// end tags inserted, stray end tags removed and, if the void-element rule is
+// enabled, void elements self-closed.
+func handleTags(curdir, infile string, f1 io.Reader, f2, fixed io.Writer, config Config) ([]Diagnostic, *Document, error) {
+	var fname string = infile
 	if infile == "" {
-		f1 = os.Stdin
+		fname = "-"
 	} else {
-		f, err := os.Open(infile)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		f1 = f
 		curdir = filepath.Join(curdir, filepath.Dir(infile))
 	}
 
 	breadcrumb := []string{}
+	bases := []string{}
+	docBase := ""
 	z := html.NewTokenizer(f1)
+	pos := Position{1, 1}
 
-	errors := 0
+	var links []Link
+	anchors := map[string]bool{}
+
+	var diags []Diagnostic
+	diag := func(pos Position, rule string, format string, args ...interface{}) {
+		diags = append(diags, Diagnostic{
+			Rule:    rule,
+			File:    fname,
+			Line:    pos.Line,
+			Column:  pos.Col,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	var checks []RuleCheck
+	for _, r := range Rules {
+		if r.New != nil {
+			id := r.Id
+			checks = append(checks, r.New(func(pos Position, format string, args ...interface{}) {
+				diag(pos, id, format, args...)
+			}))
+		}
+	}
+	ctx := &Context{}
+	fileConfig := config.Copy()
+	doc := &Document{File: fname, Config: fileConfig}
+	titleDepth := 0
+
+	// Close the top element, the end tag is written to the fixed output if
+	// missing is true
+	closeElement := func(t html.Token, missing bool) error {
+		if len(breadcrumb) == titleDepth {
+			titleDepth = -1
+			doc.Title = strings.Join(strings.Fields(doc.Title), " ")
+		}
+		ctx.Breadcrumb = breadcrumb
+		for _, c := range checks {
+			c.EndTag(ctx, t)
+		}
+		breadcrumb = breadcrumb[:len(breadcrumb)-1]
+		bases = bases[:len(bases)-1]
+		if missing && fixed != nil {
+			_, err := fixed.Write([]byte("</" + t.Data + ">"))
+			return err
+		}
+		return nil
+	}
 
 	for {
 		tt := z.Next()
 		if tt == html.ErrorToken {
 			err := z.Err()
 			if err != io.EOF {
-				return err
+				return nil, nil, err
 			}
 			break
 		}
@@ -71,47 +401,210 @@ func handleTags(curdir, infile string, f2 io.Writer) error {
 		raw0 := z.Raw()
 		rawData := make([]byte, len(raw0))
 		copy(rawData, raw0)
+		fixData := rawData
+		tokpos := pos
+		pos = pos.Advance(rawData)
+		ctx.Pos = tokpos
+
+		var t html.Token
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken || tt == html.EndTagToken {
+			t = z.Token()
+		}
+		selfClosing := tt == html.SelfClosingTagToken
 
 		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
-			t := z.Token()
+			for n := impliedEnds(breadcrumb, t.Data); n > 0; n-- {
+				err := closeElement(html.Token{Type: html.EndTagToken, Data: breadcrumb[len(breadcrumb)-1]}, false)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
 			breadcrumb = append(breadcrumb, t.Data)
 			rawData = []byte(t.String())
+
+			if tt == html.StartTagToken && voidElements[t.Data] {
+				if fileConfig.Severity("void-element") != SeverityNone {
+					diag(tokpos, "void-element", "Void element <%s> is not self-closed", t.Data)
+					fixData = bytes.TrimRight(fixData[:len(fixData)-1], " \t\r\n")
+					fixData = append(fixData[:len(fixData):len(fixData)], []byte(" />")...)
+				}
+				selfClosing = true
+			}
+
+			var base string
+			if len(bases) > 0 {
+				base = bases[len(bases)-1]
+			}
+			for _, a := range t.Attr {
+				if a.Key == "xml:base" {
+					base = joinBase(base, a.Val, true)
+				}
+			}
+			bases = append(bases, base)
+
+			for _, a := range t.Attr {
+				if a.Key == "id" || (a.Key == "name" && t.Data == "a") {
+					anchors[a.Val] = true
+				}
+			}
+
+			if t.Data == "title" && doc.Title == "" && titleDepth == 0 {
+				titleDepth = len(breadcrumb)
+				doc.TitlePos = tokpos
+			}
+
+			if href, ok := tokenAttr(t, "href"); t.Data == "link" && ok {
+				if target, ok := xrefTarget(curdir, href); ok {
+					for _, a := range t.Attr {
+						if a.Key != "rel" && a.Key != "rev" {
+							continue
+						}
+						for _, kind := range strings.Fields(a.Val) {
+							doc.XRefs = append(doc.XRefs, XRef{tokpos, a.Key, kind, target})
+						}
+					}
+				}
+			}
+
+			if t.Data == "base" {
+				href, _ := tokenAttr(t, "href")
+				docBase = joinBase(docBase, href, false)
+			} else {
+				for _, a := range t.Attr {
+					if getURL(t.Data, a.Key, a.Val) == nil {
+						continue
+					}
+					links = append(links, Link{
+						Pos:  tokpos,
+						Tag:  t.Data,
+						Attr: a.Key,
+						Val:  a.Val,
+						Base: joinBase(docBase, base, true),
+					})
+				}
+			}
+
+			ctx.Breadcrumb = breadcrumb
+			for _, c := range checks {
+				c.StartTag(ctx, t)
+			}
+		} else if tt == html.TextToken {
+			text := z.Token().Data
+			if titleDepth > 0 {
+				doc.Title += text
+			}
+			for _, c := range checks {
+				c.Text(ctx, text)
+			}
+		} else if tt == html.CommentToken {
+			settings, _ := parseConfigComment(z.Token().Data)
+			for _, setting := range settings {
+				err := fileConfig.Set(setting)
+				if err != nil {
+					diag(tokpos, "invalid-config", "%v", err)
+				}
+			}
+		} else if tt == html.EndTagToken {
+			open := len(breadcrumb) - 1
+			for open >= 0 && breadcrumb[open] != t.Data {
+				open--
+			}
+			if open < 0 {
+				diag(tokpos, "tag-mismatch", "%s: Stray end tag </%s>", strings.Join(breadcrumb, "/"), t.Data)
+				fixData = nil
+			} else {
+				explicit := explicitEnds(breadcrumb, open+1)
+				if explicit < len(breadcrumb) {
+					diag(tokpos, "tag-mismatch", "%s: Incorrect closing tag </%s>, expected </%s>", strings.Join(breadcrumb, "/"), t.Data, breadcrumb[len(breadcrumb)-1])
+				}
+				for len(breadcrumb)-1 > open {
+					err := closeElement(html.Token{Type: html.EndTagToken, Data: breadcrumb[len(breadcrumb)-1]}, len(breadcrumb) > explicit)
+					if err != nil {
+						return nil, nil, err
+					}
+				}
+			}
 		}
 
 		_, err := f2.Write(rawData)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
-		if tt == html.EndTagToken || tt == html.SelfClosingTagToken {
-			t := z.Token()
-			if t.Data != "" && t.Data != breadcrumb[len(breadcrumb)-1] {
-				fmt.Fprintf(os.Stderr, "%s: Incorrect closing tag: expected %s\n", strings.Join(breadcrumb, "/"), t.Data)
-				errors += 1
-				for len(breadcrumb) > 0 && breadcrumb[len(breadcrumb)-1] != t.Data {
-					breadcrumb = breadcrumb[:len(breadcrumb)-1]
-				}
+		if fixed != nil {
+			_, err = fixed.Write(fixData)
+			if err != nil {
+				return nil, nil, err
 			}
-			rawData = []byte(t.String())
-			breadcrumb = breadcrumb[:len(breadcrumb)-1]
 		}
 
+		if (tt == html.EndTagToken && fixData != nil) || selfClosing {
+			err = closeElement(t, false)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+	}
+
+	explicit := explicitEnds(breadcrumb, 0)
+	if explicit < len(breadcrumb) {
+		diag(pos, "unexpected-eof", "%s: Unexpected end of file", strings.Join(breadcrumb, "/"))
+	}
+	ctx.Pos = pos
+	for len(breadcrumb) > 0 {
+		err := closeElement(html.Token{Type: html.EndTagToken, Data: breadcrumb[len(breadcrumb)-1]}, len(breadcrumb) > explicit)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	if len(breadcrumb) > 0 {
-		fmt.Fprintf(os.Stderr, "%s: Unexpected enf of file", strings.Join(breadcrumb, "/"))
-		errors += 1
+	ctx.Breadcrumb = breadcrumb
+	for _, c := range checks {
+		c.EndDocument(ctx)
 	}
 
-	if errors > 0 {
-		if infile != "" {
-			return fmt.Errorf("%s: There are %d errors", infile, errors)
-		} else {
-			return fmt.Errorf("There are %d errors", infile, errors)
+	lc := &LinkChecker{
+		CurDir:  curdir,
+		Root:    rootDir,
+		Anchors: map[string]map[string]bool{},
+	}
+	if infile != "" {
+		lc.Anchors[filepath.Clean(infile)] = anchors
+	}
+	for _, l := range links {
+		status, target, err := lc.Check(infile, anchors, l)
+		if err == nil && status == LinkOK && target != "" {
+			doc.Links = append(doc.Links, target)
+		}
+		if err != nil {
+			diag(l.Pos, "broken-link", "%v", err)
+		} else if status == LinkExternal {
+			diag(l.Pos, "external-link", "External link %s", l.Val)
+		} else if status == LinkUnchecked {
+			diag(l.Pos, "unchecked-link", "Unchecked link %s (use -root)", l.Val)
 		}
 	}
 
-	return nil
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].Line != diags[j].Line {
+			return diags[i].Line < diags[j].Line
+		}
+		return diags[i].Column < diags[j].Column
+	})
+
+	var res []Diagnostic
+	for _, d := range diags {
+		d.Severity = fileConfig.Severity(d.Rule)
+		if r := findRule(d.Rule); r != nil {
+			d.WCAG = r.WCAG
+		}
+		if d.Severity != SeverityNone {
+			res = append(res, d)
+		}
+	}
+
+	return res, doc, nil
 }
 
 func getURL(tag, attr, val string) *url.URL {
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestFixEndTags(t *testing.T) {
+	tests := []struct {
+		in, want string
+		diags    []string
+	}{
+		{"<ul><li>a<li>b</ul>", "<ul><li>a<li>b</ul>", nil},
+		{"<ol><li>a<ul><li>b</ul><li>c</ol>", "<ol><li>a<ul><li>b</ul><li>c</ol>", nil},
+		{"<dl><dt>a<dd>b<dt>c<dd>d</dl>", "<dl><dt>a<dd>b<dt>c<dd>d</dl>", nil},
+		{"<table><tbody><tr><td>a<td>b<tr><th>c</table>", "<table><tbody><tr><td>a<td>b<tr><th>c</table>", nil},
+		{"<select><option>a<option>b</select>", "<select><option>a<option>b</select>", nil},
+		{"<p>a<div>b</div><p>c", "<p>a<div>b</div><p>c", nil},
+		{"<html><body><p>a", "<html><body><p>a", nil},
+		{"<div><span>a</div>", "<div><span>a</span></div>", []string{"tag-mismatch"}},
+		{"<ul><li><span>a<li>b</ul>", "<ul><li><span>a<li>b</li></span></ul>", []string{"tag-mismatch"}},
+		{"<div>a", "<div>a</div>", []string{"unexpected-eof"}},
+		{"a</span>", "a", []string{"tag-mismatch"}},
+	}
+	for _, test := range tests {
+		var fixed bytes.Buffer
+		diags, _, err := handleTags(".", "", strings.NewReader(test.in), ioutil.Discard, &fixed, Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fixed.String() != test.want {
+			t.Errorf("fix %q = %q, want %q", test.in, fixed.String(), test.want)
+		}
+		var rules []string
+		for _, d := range diags {
+			if d.Rule == "tag-mismatch" || d.Rule == "unexpected-eof" {
+				rules = append(rules, d.Rule)
+			}
+		}
+		if strings.Join(rules, ",") != strings.Join(test.diags, ",") {
+			t.Errorf("diagnostics of %q = %v, want %v", test.in, rules, test.diags)
+		}
+	}
+}
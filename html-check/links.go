@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mildred/htmltools/relurl"
+	"golang.org/x/net/html"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A link found in a src or href attribute
+type Link struct {
+	Pos  Position
+	Tag  string
+	Attr string
+	Val  string
+	Base string // base directory in effect (xml:base or <base href>)
+}
+
+type LinkStatus int
+
+const (
+	LinkOK        LinkStatus = iota
+	LinkExternal             // not on the local filesystem, not fetched
+	LinkUnchecked            // absolute path and no site root to resolve it
+)
+
+// Combine a base URL with a new xml:base or <base href> value. The result
+// always designates a directory, relative to the document directory unless
+// absolute. A <base href> designates a document, and isDir must be false.
+func joinBase(base, val string, isDir bool) string {
+	if val == "" {
+		return base
+	}
+	u, err := url.Parse(val)
+	if err != nil {
+		return base
+	}
+	if !isDir {
+		if i := strings.LastIndex(u.Path, "/"); i >= 0 {
+			u.Path = u.Path[:i+1]
+		} else {
+			u.Path = ""
+		}
+		val = u.String()
+		if val == "" {
+			return base
+		}
+	}
+	if base == "" {
+		return val
+	}
+	res, err := relurl.UrlJoinString(base, val, "")
+	if err != nil {
+		return base
+	}
+	if !strings.HasSuffix(res, "/") {
+		res += "/"
+	}
+	return res
+}
+
+// Resolve the link against its base. Links with an empty path (fragment or
+// query only) refer to the current document and are left untouched.
+func (l Link) Resolve() (*url.URL, error) {
+	u, err := url.Parse(l.Val)
+	if err != nil {
+		return nil, err
+	}
+	if l.Base == "" || (u.Scheme == "" && u.Host == "" && u.Path == "") {
+		return u, nil
+	}
+	b, err := url.Parse(l.Base)
+	if err != nil {
+		return nil, err
+	}
+	res, err := relurl.UrlJoin(b, u, "")
+	if err != nil {
+		return nil, err
+	}
+	return url.Parse(res)
+}
+
+type LinkChecker struct {
+	CurDir  string                     // directory of the document
+	Root    string                     // site root for absolute paths
+	Anchors map[string]map[string]bool // anchors per file, cached
+}
+
+// Check a link found in infile and return the file it points to. anchors are
+// the anchors of the current document, used for fragment only links.
+func (lc *LinkChecker) Check(infile string, anchors map[string]bool, l Link) (LinkStatus, string, error) {
+	target := infile
+	u, err := l.Resolve()
+	if err != nil {
+		return LinkOK, target, fmt.Errorf("Invalid link %s: %v", l.Val, err)
+	}
+
+	if (u.Scheme != "" && u.Scheme != "file") || u.Host != "" {
+		return LinkExternal, target, nil
+	}
+
+	if u.Path != "" {
+		if path.IsAbs(u.Path) && u.Scheme != "file" {
+			if lc.Root == "" {
+				return LinkUnchecked, target, nil
+			}
+			target = filepath.Join(lc.Root, filepath.FromSlash(u.Path))
+		} else if path.IsAbs(u.Path) {
+			target = filepath.FromSlash(u.Path)
+		} else {
+			target = filepath.Join(lc.CurDir, filepath.FromSlash(u.Path))
+		}
+
+		st, err := os.Stat(target)
+		if err != nil {
+			return LinkOK, target, fmt.Errorf("Broken link to %s: %s does not exist", l.Val, target)
+		}
+		if st.IsDir() {
+			target = filepath.Join(target, "index.html")
+			_, err = os.Stat(target)
+			if err != nil {
+				return LinkOK, target, fmt.Errorf("Broken link to %s: %s does not exist", l.Val, target)
+			}
+		}
+		anchors = nil
+	}
+
+	if u.Fragment == "" || u.Fragment == "top" {
+		return LinkOK, target, nil
+	}
+
+	if anchors == nil {
+		if !isHTMLFile(target) {
+			return LinkOK, target, nil
+		}
+		anchors, err = lc.anchors(target)
+		if err != nil {
+			return LinkOK, target, err
+		}
+	}
+
+	if !anchors[u.Fragment] {
+		return LinkOK, target, fmt.Errorf("Broken link to %s: no anchor #%s in %s", l.Val, u.Fragment, target)
+	}
+
+	return LinkOK, target, nil
+}
+
+func (lc *LinkChecker) anchors(fname string) (map[string]bool, error) {
+	fname = filepath.Clean(fname)
+	if anchors, ok := lc.Anchors[fname]; ok {
+		return anchors, nil
+	}
+	anchors, err := readAnchors(fname)
+	if err != nil {
+		return nil, err
+	}
+	lc.Anchors[fname] = anchors
+	return anchors, nil
+}
+
+func isHTMLFile(fname string) bool {
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".html", ".htm", ".xhtml", ".xml", ".svg":
+		return true
+	default:
+		return false
+	}
+}
+
+// Return the id attributes and <a name> of a document
+func readAnchors(fname string) (map[string]bool, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	anchors := map[string]bool{}
+	z := html.NewTokenizer(f)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			err := z.Err()
+			if err != io.EOF {
+				return nil, err
+			}
+			return anchors, nil
+		}
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
+			t := z.Token()
+			for _, a := range t.Attr {
+				if a.Key == "id" || (a.Key == "name" && t.Data == "a") {
+					anchors[a.Val] = true
+				}
+			}
+		}
+	}
+}
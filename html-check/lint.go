@@ -0,0 +1,264 @@
+package main
+
+import (
+	"golang.org/x/net/html"
+	"strings"
+)
+
+func init() {
+	Rules = append(Rules,
+		&Rule{
+			Id:          "duplicate-id",
+			Group:       "lint",
+			Severity:    SeverityError,
+			Description: "The same id is used by more than one element",
+			New:         func(r ReportFunc) RuleCheck { return &duplicateIdCheck{report: r, ids: map[string]Position{}} },
+		},
+		&Rule{
+			Id:          "img-alt",
+			Group:       "a11y",
+			Severity:    SeverityWarning,
+			Description: "<img>, <area> or <input type=\"image\"> without alt attribute",
+			WCAG:        []string{"1.1.1"},
+			New:         func(r ReportFunc) RuleCheck { return &imgAltCheck{report: r} },
+		},
+		&Rule{
+			Id:          "document-title",
+			Group:       "lint",
+			Severity:    SeverityWarning,
+			Description: "<html> document without <title>",
+			New:         func(r ReportFunc) RuleCheck { return &documentTitleCheck{report: r} },
+		},
+		&Rule{
+			Id:          "html-lang",
+			Group:       "a11y",
+			Severity:    SeverityWarning,
+			Description: "<html> without lang attribute",
+			WCAG:        []string{"3.1.1"},
+			New:         func(r ReportFunc) RuleCheck { return &htmlLangCheck{report: r} },
+		},
+		&Rule{
+			Id:          "unprocessed-tag",
+			Group:       "lint",
+			Severity:    SeverityWarning,
+			Description: "htmltools tag left in the document, a pipeline stage is missing",
+			New:         func(r ReportFunc) RuleCheck { return &unprocessedTagCheck{report: r} },
+		},
+		&Rule{
+			Id:          "obsolete-element",
+			Group:       "lint",
+			Severity:    SeverityWarning,
+			Description: "Element obsolete in HTML5",
+			New:         func(r ReportFunc) RuleCheck { return &obsoleteElementCheck{report: r} },
+		},
+		&Rule{
+			Id:          "empty-link",
+			Group:       "a11y",
+			Severity:    SeverityWarning,
+			Description: "<a href> without accessible name",
+			WCAG:        []string{"2.4.4", "4.1.2"},
+			New:         func(r ReportFunc) RuleCheck { return &emptyLinkCheck{report: r} },
+		},
+		&Rule{
+			Id:          "heading-order",
+			Group:       "lint",
+			Severity:    SeverityWarning,
+			Description: "Heading level skipped (e.g. <h2> followed by <h4>)",
+			New:         func(r ReportFunc) RuleCheck { return &headingOrderCheck{report: r} },
+		})
+}
+
+func tokenAttr(t html.Token, name string) (string, bool) {
+	for _, a := range t.Attr {
+		if a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+type duplicateIdCheck struct {
+	baseCheck
+	report ReportFunc
+	ids    map[string]Position
+}
+
+func (c *duplicateIdCheck) StartTag(ctx *Context, t html.Token) {
+	id, ok := tokenAttr(t, "id")
+	if !ok {
+		return
+	}
+	if pos, exists := c.ids[id]; exists {
+		c.report(ctx.Pos, "Duplicate id %#v, first defined at %v", id, pos)
+	} else {
+		c.ids[id] = ctx.Pos
+	}
+}
+
+type imgAltCheck struct {
+	baseCheck
+	report ReportFunc
+}
+
+func (c *imgAltCheck) StartTag(ctx *Context, t html.Token) {
+	if typ, _ := tokenAttr(t, "type"); t.Data != "img" && t.Data != "area" && (t.Data != "input" || typ != "image") {
+		return
+	}
+	if _, ok := tokenAttr(t, "alt"); !ok && !hasLabelAttr(t) {
+		c.report(ctx.Pos, "<%s> without alt attribute", t.Data)
+	}
+}
+
+// Only full documents are checked, not fragments without <html>
+type documentTitleCheck struct {
+	baseCheck
+	report  ReportFunc
+	htmlPos *Position
+	title   bool
+}
+
+func (c *documentTitleCheck) StartTag(ctx *Context, t html.Token) {
+	if t.Data == "html" && c.htmlPos == nil {
+		pos := ctx.Pos
+		c.htmlPos = &pos
+	} else if t.Data == "title" {
+		c.title = true
+	}
+}
+
+func (c *documentTitleCheck) EndDocument(ctx *Context) {
+	if c.htmlPos != nil && !c.title {
+		c.report(*c.htmlPos, "Document without <title>")
+	}
+}
+
+type htmlLangCheck struct {
+	baseCheck
+	report ReportFunc
+}
+
+func (c *htmlLangCheck) StartTag(ctx *Context, t html.Token) {
+	if t.Data != "html" {
+		return
+	}
+	lang, ok := tokenAttr(t, "lang")
+	if !ok {
+		lang, ok = tokenAttr(t, "xml:lang")
+	}
+	if !ok || strings.TrimSpace(lang) == "" {
+		c.report(ctx.Pos, "<html> without lang attribute")
+	}
+}
+
+// Tags evaluated by the htmltools, and the tool responsible for them
+var unprocessedTags = map[string]string{
+	"include-file":      "html-includetag",
+	"include-content":   "html-includetag",
+	"markdown":          "html-markdown",
+	"template-instance": "html-template",
+	"backlink-list":     "html-backlink-list",
+	"pagination":        "html-paginate",
+}
+
+type unprocessedTagCheck struct {
+	baseCheck
+	report ReportFunc
+}
+
+func (c *unprocessedTagCheck) StartTag(ctx *Context, t html.Token) {
+	if tool, ok := unprocessedTags[t.Data]; ok {
+		c.report(ctx.Pos, "Unprocessed <%s>, %s was not run", t.Data, tool)
+	}
+}
+
+var obsoleteElements = map[string]bool{
+	"acronym":   true,
+	"applet":    true,
+	"basefont":  true,
+	"big":       true,
+	"blink":     true,
+	"center":    true,
+	"dir":       true,
+	"font":      true,
+	"frame":     true,
+	"frameset":  true,
+	"isindex":   true,
+	"listing":   true,
+	"marquee":   true,
+	"nobr":      true,
+	"noframes":  true,
+	"plaintext": true,
+	"spacer":    true,
+	"strike":    true,
+	"tt":        true,
+	"xmp":       true,
+}
+
+type obsoleteElementCheck struct {
+	baseCheck
+	report ReportFunc
+}
+
+func (c *obsoleteElementCheck) StartTag(ctx *Context, t html.Token) {
+	if obsoleteElements[t.Data] {
+		c.report(ctx.Pos, "Obsolete element <%s>", t.Data)
+	}
+}
+
+// A link has an accessible name if it contains text, an image with
+// alternative text or has a label attribute
+type emptyLinkCheck struct {
+	baseCheck
+	report  ReportFunc
+	depth   int // depth of the open <a href>, 0 if none
+	pos     Position
+	content bool
+}
+
+func (c *emptyLinkCheck) StartTag(ctx *Context, t html.Token) {
+	if c.depth > 0 {
+		if alt, _ := tokenAttr(t, "alt"); t.Data == "img" && strings.TrimSpace(alt) != "" {
+			c.content = true
+		}
+		return
+	}
+	if _, ok := tokenAttr(t, "href"); t.Data != "a" || !ok {
+		return
+	}
+	c.depth = len(ctx.Breadcrumb)
+	c.pos = ctx.Pos
+	c.content = hasLabelAttr(t)
+}
+
+func (c *emptyLinkCheck) Text(ctx *Context, text string) {
+	if c.depth > 0 && strings.TrimSpace(text) != "" {
+		c.content = true
+	}
+}
+
+func (c *emptyLinkCheck) EndTag(ctx *Context, t html.Token) {
+	if c.depth == 0 || t.Data != "a" || len(ctx.Breadcrumb) != c.depth {
+		return
+	}
+	if !c.content {
+		c.report(c.pos, "Link without accessible name")
+	}
+	c.depth = 0
+}
+
+type headingOrderCheck struct {
+	baseCheck
+	report ReportFunc
+	level  int
+}
+
+func (c *headingOrderCheck) StartTag(ctx *Context, t html.Token) {
+	if len(t.Data) != 2 || t.Data[0] != 'h' || t.Data[1] < '1' || t.Data[1] > '6' {
+		return
+	}
+	level := int(t.Data[1] - '0')
+	if c.level > 0 && level > c.level+1 {
+		c.report(ctx.Pos, "Heading level skipped: <h%d> after <h%d>", level, c.level)
+	}
+	c.level = level
+}
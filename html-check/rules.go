@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/net/html"
+	"io"
+	"os"
+	"strings"
+)
+
+type ReportFunc func(pos Position, format string, args ...interface{})
+
+// State of the document shared with the rules
+type Context struct {
+	Pos        Position // position of the current token
+	Breadcrumb []string // open elements, including the current start tag
+}
+
+// A rule check is instanciated for each document and receives its tokens
+type RuleCheck interface {
+	StartTag(ctx *Context, t html.Token)
+	EndTag(ctx *Context, t html.Token)
+	Text(ctx *Context, text string)
+	EndDocument(ctx *Context)
+}
+
+// Embed to implement only part of RuleCheck
+type baseCheck struct{}
+
+func (baseCheck) StartTag(ctx *Context, t html.Token) {}
+func (baseCheck) EndTag(ctx *Context, t html.Token)   {}
+func (baseCheck) Text(ctx *Context, text string)      {}
+func (baseCheck) EndDocument(ctx *Context)            {}
+
+type Rule struct {
+	Id          string
+	Group       string   // rules can be configured by group
+	Severity    Severity // default severity, SeverityNone if disabled
+	Description string
+	WCAG        []string                          // WCAG success criteria, e.g. "1.1.1"
+	New         func(report ReportFunc) RuleCheck // nil for checks built in handleTags
+}
+
+var Rules []*Rule = []*Rule{
+	{Id: "tag-mismatch", Group: "core", Severity: SeverityError, Description: "Closing tag does not match the open element"},
+	{Id: "unexpected-eof", Group: "core", Severity: SeverityError, Description: "Elements left open at end of file"},
+	{Id: "void-element", Group: "core", Severity: SeverityNone, Description: "Void element not self-closed (e.g. <br> instead of <br />), for XHTML documents"},
+	{Id: "invalid-config", Group: "core", Severity: SeverityError, Description: "Invalid <!-- html-check --> configuration comment"},
+	{Id: "broken-link", Group: "links", Severity: SeverityError, Description: "Local link target or fragment anchor does not exist"},
+	{Id: "external-link", Group: "links", Severity: SeverityInfo, Description: "External link, not checked"},
+	{Id: "unchecked-link", Group: "links", Severity: SeverityInfo, Description: "Absolute path link that cannot be resolved without -root"},
+	{Id: "orphan-page", Group: "site", Severity: SeverityWarning, Description: "Page not linked from any other checked page"},
+	{Id: "duplicate-title", Group: "site", Severity: SeverityWarning, Description: "Same <title> used by several pages"},
+	{Id: "unbalanced-xref", Group: "site", Severity: SeverityWarning, Description: "<link rel|rev> without its reverse link in the target"},
+}
+
+func findRule(id string) *Rule {
+	for _, r := range Rules {
+		if r.Id == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// Configuration of the rules, maps rule ids to their severity. Rules absent
+// from the map use their default severity, rules mapped to SeverityNone are
+// disabled.
+type Config map[string]Severity
+
+func (c Config) Severity(rule string) Severity {
+	if s, ok := c[rule]; ok {
+		return s
+	}
+	r := findRule(rule)
+	if r == nil {
+		return SeverityError
+	}
+	return r.Severity
+}
+
+// Return a copy of the configuration
+func (c Config) Copy() Config {
+	res := Config{}
+	for k, v := range c {
+		res[k] = v
+	}
+	return res
+}
+
+// Set a rule from a "rule=severity" setting. The severity can be "on" to
+// enable the rule with its default severity or "off" to disable it.
+func (c Config) Set(setting string) error {
+	kv := strings.SplitN(setting, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("Invalid rule setting %#v, expected rule=severity", setting)
+	}
+	return c.SetRule(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+}
+
+// Configure a rule, or all the rules of a group
+func (c Config) SetRule(id, val string) error {
+	r := findRule(id)
+	if r == nil {
+		found := false
+		for _, r := range Rules {
+			if r.Group == id {
+				found = true
+				err := c.SetRule(r.Id, val)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown rule %#v", id)
+		}
+		return nil
+	}
+	switch val {
+	case "on":
+		c[id] = r.Severity
+		if r.Severity == SeverityNone {
+			c[id] = SeverityWarning
+		}
+	case "off":
+		c[id] = SeverityNone
+	default:
+		s, err := ParseSeverity(val)
+		if err != nil {
+			return err
+		}
+		c[id] = s
+	}
+	return nil
+}
+
+// Read a configuration file. Each line contains a rule=severity setting,
+// empty lines and lines starting with # are ignored.
+func ReadConfig(r io.Reader, c Config) error {
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err := c.Set(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func ReadConfigFile(fname string, c Config) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = ReadConfig(f, c)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fname, err)
+	}
+	return nil
+}
+
+// Parse a <!-- html-check rule=severity ... --> comment, return false if the
+// comment is not for html-check
+func parseConfigComment(comment string) ([]string, bool) {
+	fields := strings.Fields(comment)
+	if len(fields) == 0 || strings.TrimSuffix(fields[0], ":") != "html-check" {
+		return nil, false
+	}
+	return fields[1:], true
+}
+
+func printRules(w io.Writer) {
+	for _, r := range Rules {
+		severity := r.Severity.String()
+		if r.Severity == SeverityNone {
+			severity = "off"
+		}
+		description := r.Description
+		if len(r.WCAG) > 0 {
+			description += " (WCAG " + strings.Join(r.WCAG, ", ") + ")"
+		}
+		fmt.Fprintf(w, "%-20s %-6s %-8s %s\n", r.Id, r.Group, severity, description)
+	}
+}
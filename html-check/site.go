@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Summary of a document used by the site wide checks
+type Document struct {
+	File     string
+	Config   Config
+	Title    string
+	TitlePos Position
+	Links    []string // local files linked from the document
+	XRefs    []XRef   // <link rel|rev href> elements
+}
+
+// A typed link between pages as maintained by htmlxref
+type XRef struct {
+	Pos       Position
+	Direction string // rel or rev
+	Kind      string
+	Target    string
+}
+
+// File pointed to by the href of a <link>, false for external links and
+// links to the document itself. Absolute paths need the site root.
+func xrefTarget(curdir, href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+	if path.IsAbs(u.Path) {
+		if rootDir == "" {
+			return "", false
+		}
+		return filepath.Join(rootDir, filepath.FromSlash(u.Path)), true
+	}
+	return filepath.Join(curdir, filepath.FromSlash(u.Path)), true
+}
+
+func reverse(direction string) string {
+	if direction == "rel" {
+		return "rev"
+	}
+	return "rel"
+}
+
+// Expand the command line arguments to a list of files. Directories are
+// walked for HTML files and patterns are globbed. site is true if more than
+// one file can be checked, entries are the index.html of the directories.
+func expandArgs(args []string) (files, entries []string, site bool, err error) {
+	seen := map[string]bool{}
+	add := func(fname string) {
+		fname = filepath.Clean(fname)
+		if !seen[fname] {
+			seen[fname] = true
+			files = append(files, fname)
+		}
+	}
+
+	site = len(args) > 1
+	for _, arg := range args {
+		if arg == "-" {
+			files = append(files, "")
+			continue
+		}
+
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			site = true
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, nil, false, err
+			}
+		}
+
+		for _, match := range matches {
+			st, err := os.Stat(match)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			if !st.IsDir() {
+				add(match)
+				continue
+			}
+			site = true
+			entries = append(entries, filepath.Join(match, "index.html"))
+			err = filepath.Walk(match, func(fname string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				switch strings.ToLower(filepath.Ext(fname)) {
+				case ".html", ".htm", ".xhtml":
+					if !info.IsDir() {
+						add(fname)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, nil, false, err
+			}
+		}
+	}
+	return
+}
+
+type Result struct {
+	Diags []Diagnostic
+	Doc   *Document
+	Out   []byte // diff or fixed document to print on stdout
+	Err   error
+}
+
+// Check files concurrently using jobs workers, results are in the same order
+// as files
+func checkFiles(files []string, jobs int, check func(infile string) Result) []Result {
+	results := make([]Result, len(files))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	if jobs < 1 {
+		jobs = 1
+	}
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				results[i] = check(files[i])
+			}
+		}()
+	}
+	for i := range files {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return results
+}
+
+func absPath(fname string) string {
+	abs, err := filepath.Abs(fname)
+	if err != nil {
+		return filepath.Clean(fname)
+	}
+	return abs
+}
+
+// Checks that need all the documents: orphan pages, duplicate titles and
+// unbalanced <link rel|rev> pairs
+func siteChecks(docs []*Document, entries []string) []Diagnostic {
+	var diags []Diagnostic
+	diag := func(doc *Document, pos Position, rule string, format string, args ...interface{}) {
+		severity := doc.Config.Severity(rule)
+		if severity == SeverityNone {
+			return
+		}
+		diags = append(diags, Diagnostic{
+			Rule:     rule,
+			Severity: severity,
+			File:     doc.File,
+			Line:     pos.Line,
+			Column:   pos.Col,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	pages := map[string]*Document{}
+	for _, doc := range docs {
+		pages[absPath(doc.File)] = doc
+	}
+
+	linked := map[string]bool{}
+	for _, e := range entries {
+		linked[absPath(e)] = true
+	}
+	for _, doc := range docs {
+		self := absPath(doc.File)
+		for _, l := range doc.Links {
+			if target := absPath(l); target != self {
+				linked[target] = true
+			}
+		}
+	}
+	for _, doc := range docs {
+		if !linked[absPath(doc.File)] {
+			diag(doc, Position{1, 1}, "orphan-page", "Page not linked from any other page")
+		}
+	}
+
+	titles := map[string][]*Document{}
+	var titleList []string
+	for _, doc := range docs {
+		if doc.Title == "" {
+			continue
+		}
+		if titles[doc.Title] == nil {
+			titleList = append(titleList, doc.Title)
+		}
+		titles[doc.Title] = append(titles[doc.Title], doc)
+	}
+	sort.Strings(titleList)
+	for _, title := range titleList {
+		for _, doc := range titles[title][1:] {
+			diag(doc, doc.TitlePos, "duplicate-title", "Duplicate title %#v, also used by %s", title, titles[title][0].File)
+		}
+	}
+
+	type xrefKey struct{ source, direction, kind, target string }
+	xrefs := map[xrefKey]bool{}
+	for _, doc := range docs {
+		for _, x := range doc.XRefs {
+			xrefs[xrefKey{absPath(doc.File), x.Direction, x.Kind, absPath(x.Target)}] = true
+		}
+	}
+	for _, doc := range docs {
+		source := absPath(doc.File)
+		for _, x := range doc.XRefs {
+			target := absPath(x.Target)
+			other := pages[target]
+			if other == nil || target == source {
+				continue
+			}
+			if !xrefs[xrefKey{target, reverse(x.Direction), x.Kind, source}] {
+				href, err := filepath.Rel(filepath.Dir(target), source)
+				if err != nil {
+					href = source
+				}
+				diag(doc, x.Pos, "unbalanced-xref", "Missing <link %s=\"%s\" href=\"%s\"> in %s (run htmlxref)", reverse(x.Direction), x.Kind, filepath.ToSlash(href), other.File)
+			}
+		}
+	}
+
+	return diags
+}
@@ -82,6 +82,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	err = w.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
 	os.Exit(0)
 }
 
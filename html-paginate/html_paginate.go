@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/xml"
 	"flag"
 	"fmt"
+	"github.com/mildred/htmltools/multifiles"
 	"github.com/mildred/htmltools/parser"
 	_ "github.com/mildred/htmltools/relurl"
+	"github.com/mildred/xml-dom"
+	"github.com/mildred/xml-dom/xpath"
 	"io"
 	"io/ioutil"
-	"launchpad.net/xmlpath"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -31,6 +35,7 @@ func main() {
 	chdir := flag.String("C", "", "Change directory before operation")
 	verb := flag.Bool("v", false, "Be verbose")
 	name := flag.String("n", "", "File name")
+	multifile := flag.Bool("multifile", false, "Write all the pages as a multifiles stream on stdout instead of creating files")
 	flag.Parse()
 	infile := flag.Arg(0)
 
@@ -73,7 +78,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	err := handleTags(dir, filepath.Base(*name), f1, os.Stdout)
+	var mw *multifiles.Writer
+	if *multifile {
+		mw = multifiles.NewWriter(os.Stdout)
+	}
+
+	err := handleTags(dir, filepath.Base(*name), f1, os.Stdout, mw)
+	if err == nil && mw != nil {
+		err = mw.Close()
+	}
 	if err != nil && err != io.EOF {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
@@ -83,14 +96,47 @@ func main() {
 }
 
 type Pagination struct {
-	InPath   *xmlpath.Path
-	ForPath  *xmlpath.Path
-	MetaHead *xmlpath.Path
+	// Name used to tell paginations apart in meta, link and file names, can
+	// be empty if there is a single pagination
+	Name     string
+	InPath   *xpath.Expr
+	ForPath  *xpath.Expr
+	MetaHead *xpath.Expr
 	FileName string
 	PageSize int
+	// Numbered pages anchored from the oldest item, only the newest page
+	// changes when items are added
+	Stable bool
+	// Items are in newest first order in the document
+	NewestFirst bool
+	// Output the items newest first in each page
+	Reverse bool
+	// Generate the cross product of the pages of all the paginations instead
+	// of independent page sets
+	Cross bool
+	// Split the items in archive pages by year or month instead of fixed size
+	// pages, using the date found at KeyPath in each item
+	By      string
+	KeyPath *xpath.Expr
+
+	pages    [][]int
+	keys     []string // archive of each page
+	lastPage []int
+}
+
+func (pagination *Pagination) fileNameArgs(srcfile string, index int) TemplateArgs {
+	args := fileNameArgs(srcfile, pagination.Name, pagination.FileName, index)
+	if index >= 0 && index < len(pagination.keys) {
+		key := pagination.keys[index]
+		args.year = key[:4]
+		if len(key) >= 7 {
+			args.month = key[5:7]
+		}
+	}
+	return args
 }
 
-func readPagination(r io.Reader) (w *os.File, pagination Pagination, err error) {
+func readPagination(r io.Reader) (w *os.File, paginations []*Pagination, err error) {
 	// Prepare copy of file without the pagination tag
 	w, err = ioutil.TempFile("", "html-paginate.temp.html")
 	if err != nil {
@@ -99,12 +145,16 @@ func readPagination(r io.Reader) (w *os.File, pagination Pagination, err error)
 	defer os.Remove(w.Name())
 	defer w.Seek(0, 0)
 
+	names := map[string]bool{}
 	p := parser.NewParser(r)
 	for {
 
 		err = p.Next()
 		if err == io.EOF {
 			err = nil
+			if len(paginations) > 1 && names[""] {
+				err = fmt.Errorf("More than one <pagination />, each need a name attribute")
+			}
 			return
 		} else if err != nil {
 			return
@@ -114,14 +164,51 @@ func readPagination(r io.Reader) (w *os.File, pagination Pagination, err error)
 
 		if p.IsStartTag() && p.Data() == "pagination" {
 
+			name := p.AttrVal("name", "")
 			forPath := p.AttrVal("for", "")
 			inPath := p.AttrVal("in", "")
 			metaHead := p.AttrVal("head", "")
-			filename := p.AttrVal("filename", "${basename}.${pagenum}.${ext}")
+			defaultFileName := "${basename}.${pagenum}.${ext}"
+			if name != "" {
+				defaultFileName = "${basename}.${name}.${num}.${ext}"
+			}
+			by := p.AttrVal("by", "")
+			keyPath := p.AttrVal("key", ".//time/@datetime")
+			if by == "year" {
+				defaultFileName = "${basename}.${year}.${ext}"
+			} else if by == "month" {
+				defaultFileName = "${basename}.${year}-${month}.${ext}"
+			} else if by != "" {
+				err = fmt.Errorf("<pagination by=%#v /> must be year or month", by)
+				return
+			}
+			if by != "" && name != "" {
+				defaultFileName = strings.Replace(defaultFileName, "${basename}", "${basename}.${name}", 1)
+			}
+			filename := p.AttrVal("filename", defaultFileName)
 			pageSize, _ := strconv.Atoi(p.AttrVal("size", "10"))
 			if pageSize <= 0 {
 				pageSize = 10
 			}
+			mode := p.AttrVal("mode", "default")
+			newest := p.AttrVal("newest", "last")
+			reverse := p.Attr("reverse") != nil && p.AttrVal("reverse", "") != "false"
+			combine := p.AttrVal("combine", "independent")
+
+			if mode != "default" && mode != "stable" {
+				err = fmt.Errorf("<pagination mode=%#v /> must be default or stable", mode)
+				return
+			}
+
+			if newest != "first" && newest != "last" {
+				err = fmt.Errorf("<pagination newest=%#v /> must be first or last", newest)
+				return
+			}
+
+			if combine != "independent" && combine != "cross" {
+				err = fmt.Errorf("<pagination combine=%#v /> must be independent or cross", combine)
+				return
+			}
 
 			if forPath == "" {
 				err = fmt.Errorf("<pagination /> with empty for attribute")
@@ -133,33 +220,48 @@ func readPagination(r io.Reader) (w *os.File, pagination Pagination, err error)
 				return
 			}
 
-			if pagination.ForPath != nil {
-				err = fmt.Errorf("More than one <pagination />")
+			if names[name] {
+				err = fmt.Errorf("More than one <pagination name=%#v />", name)
 				return
 			}
+			names[name] = true
 
-			pagination = Pagination{
-				FileName: filename,
-				PageSize: pageSize,
+			pagination := &Pagination{
+				Name:        name,
+				FileName:    filename,
+				PageSize:    pageSize,
+				Stable:      mode == "stable",
+				NewestFirst: newest == "first",
+				Reverse:     reverse,
+				Cross:       combine == "cross",
+				By:          by,
 			}
 
-			pagination.ForPath, err = xmlpath.Compile(forPath)
+			if by != "" {
+				pagination.KeyPath, err = xpath.Compile(keyPath)
+				if err != nil {
+					return
+				}
+			}
+
+			pagination.ForPath, err = xpath.Compile(forPath)
 			if err != nil {
 				return
 			}
 
-			pagination.InPath, err = xmlpath.Compile(inPath)
+			pagination.InPath, err = xpath.Compile(inPath)
 			if err != nil {
 				return
 			}
 
 			if metaHead != "" {
-				pagination.MetaHead, err = xmlpath.Compile(metaHead)
+				pagination.MetaHead, err = xpath.Compile(metaHead)
 				if err != nil {
 					return
 				}
 			}
 
+			paginations = append(paginations, pagination)
 			raw = nil
 		}
 
@@ -173,44 +275,200 @@ func readPagination(r io.Reader) (w *os.File, pagination Pagination, err error)
 	}
 }
 
-func handleTags(curdir, curfile string, r io.Reader, w io.Writer) error {
+// Paginate the document, the latest page is written to w and the other pages
+// are created next to it, or all the pages are written to mw if not nil
+func handleTags(curdir, curfile string, r io.Reader, w io.Writer, mw *multifiles.Writer) error {
 	var err error
 	var r2 *os.File
-	var pagination Pagination
-	var in *xmlpath.Node
+	var paginations []*Pagination
+	var in *xmldom.Node
+	var doctype string
 
-	r2, pagination, err = readPagination(r)
+	r2, paginations, err = readPagination(r)
 	if r2 != nil {
 		defer r2.Close()
 	}
 	if err != nil {
 		return err
-	} else if pagination.ForPath == nil {
+	} else if len(paginations) == 0 {
+		if mw != nil {
+			err = mw.Next(curfile)
+			if err != nil {
+				return err
+			}
+			w = mw
+		}
 		_, err = io.Copy(w, r2)
 		return err
 	}
 
-	in, err = xmlpath.ParseHTML(r2)
+	// each document is rendered on a fresh parse of the input
+	parse := func() (*xmldom.Node, error) {
+		_, err := r2.Seek(0, 0)
+		if err != nil {
+			return nil, err
+		}
+		doc, dt, err := parseHTML(r2)
+		doctype = dt
+		return doc, err
+	}
+
+	in, err = parse()
 	if err != nil {
 		return err
 	}
 
-	nodes := pagination.ForPath.Iter(in).Nodes()
-	pages, lastPage := computePages(pagination.PageSize, len(nodes))
+	cross := false
+	for _, pagination := range paginations {
+		nodes := pagination.ForPath.EvaluateNode(in).Nodes()
+		if pagination.By != "" {
+			var dates []string
+			for _, node := range nodes {
+				date, _ := pathString(pagination.KeyPath, node)
+				dates = append(dates, date)
+			}
+			pagination.pages, pagination.keys, pagination.lastPage, err = computeArchivePages(dates, pagination.By, pagination.Reverse)
+			if err != nil {
+				return err
+			}
+		} else if pagination.Stable {
+			pagination.pages, pagination.lastPage = computeStablePages(pagination.PageSize, len(nodes), pagination.NewestFirst, pagination.Reverse)
+		} else {
+			pagination.pages, pagination.lastPage = computePages(pagination.PageSize, len(nodes), pagination.Reverse)
+		}
+		cross = cross || pagination.Cross
+	}
+
+	// Page of each pagination shown in the documents to create, -1 for the
+	// latest page
+	var documents [][]int
+	latest := make([]int, len(paginations))
+	for i := range latest {
+		latest[i] = -1
+	}
+	if cross {
+		states := append([]int(nil), latest...)
+		for {
+			// next combination, the pagination states are digits
+			i := len(states) - 1
+			for i >= 0 && states[i] == len(paginations[i].pages)-1 {
+				states[i] = -1
+				i--
+			}
+			if i < 0 {
+				break
+			}
+			states[i]++
+			documents = append(documents, append([]int(nil), states...))
+		}
+	} else {
+		for i, pagination := range paginations {
+			for pageidx := range pagination.pages {
+				states := append([]int(nil), latest...)
+				states[i] = pageidx
+				documents = append(documents, states)
+			}
+		}
+	}
+
+	fileName := func(states []int) string {
+		if cross {
+			return crossFileName(curfile, paginations, states)
+		}
+		for i, pagination := range paginations {
+			if states[i] >= 0 {
+				return expandFileName(pagination.fileNameArgs(curfile, states[i]))
+			}
+		}
+		return curfile
+	}
+
+	render := func(doc *xmldom.Node, states []int) error {
+		docfile := fileName(states)
+		// the canonical link comes from the pagination whose page is
+		// shown by the document
+		owner := 0
+		for i := range states {
+			if !cross && states[i] >= 0 {
+				owner = i
+				break
+			}
+		}
+		for i, pagination := range paginations {
+			i := i
+			var page []int
+			if states[i] < 0 {
+				page = pagination.lastPage
+				log("Last page of %s contains %v\n", pagination.Name, page)
+			} else {
+				page = pagination.pages[states[i]]
+				log("Page %d of %s contains %v\n", states[i]+1, pagination.Name, page)
+			}
+			err := createPage(doc, pagination, page, PageMeta{
+				index:     states[i],
+				size:      len(pagination.pages),
+				keys:      pagination.keys,
+				name:      pagination.Name,
+				srcfile:   curfile,
+				docfile:   docfile,
+				template:  pagination.FileName,
+				head:      pagination.MetaHead,
+				duplicate: len(pagination.pages) > 0 && sameItems(pagination.lastPage, pagination.pages[len(pagination.pages)-1]),
+				canonical: i == owner,
+				links:     len(paginations) == 1 || (!cross && states[i] >= 0),
+				nav:       i == 0,
+				fileOf: func(index int) string {
+					s := append([]int(nil), states...)
+					if !cross {
+						s = append([]int(nil), latest...)
+					}
+					s[i] = index
+					return fileName(s)
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if mw != nil {
+		err = render(in, latest)
+		if err == nil {
+			err = mw.Next(curfile)
+		}
+		if err == nil {
+			_, err = io.WriteString(mw, doctype+in.XML())
+		}
+		if err != nil {
+			return err
+		}
+	}
 
-	for pageidx, page := range pages {
-		log("Page %d contains %v\n", pageidx+1, page)
+	for _, states := range documents {
+		in2, err := parse()
+		if err != nil {
+			return err
+		}
+		fname := fileName(states)
+		err = render(in2, states)
+		if err != nil {
+			return err
+		}
+		//log("Page %d: %#v\n", pageidx+1, in2.XML())
 
-		in2 := in.Copy().Ref
-		fname := expandFileName(fileNameArgs(curfile, pagination.FileName, pageidx))
-		createPage(in2, pagination.ForPath, pagination.InPath, page, PageMeta{
-			index:    pageidx,
-			size:     len(pages),
-			srcfile:  curfile,
-			template: pagination.FileName,
-			head:     pagination.MetaHead,
-		})
-		//log("Page %d: %#v\n", pageidx+1, string(in2.Node.XML()))
+		if mw != nil {
+			logv("Page %s\n", fname)
+			err = mw.Next(fname)
+			if err == nil {
+				_, err = io.WriteString(mw, doctype+in2.XML())
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
 
 		err = func() error {
 			logv("Create page %s\n", fname)
@@ -222,7 +480,7 @@ func handleTags(curdir, curfile string, r io.Reader, w io.Writer) error {
 			}
 			defer f.Close()
 
-			_, err = f.Write(in2.Node.XML())
+			_, err = io.WriteString(f, doctype+in2.XML())
 			return err
 		}()
 
@@ -231,30 +489,140 @@ func handleTags(curdir, curfile string, r io.Reader, w io.Writer) error {
 		}
 	}
 
-	log("Last page contains %v\n", lastPage)
-	inref := in.Ref
-	createPage(inref, pagination.ForPath, pagination.InPath, lastPage, PageMeta{
-		index:    -1,
-		size:     len(pages),
-		srcfile:  curfile,
-		template: pagination.FileName,
-		head:     pagination.MetaHead,
-	})
-	_, err = w.Write(inref.Node.XML())
+	if mw != nil {
+		return nil
+	}
+
+	err = render(in, latest)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, doctype+in.XML())
 	return err
 }
 
+// Parse an HTML-like document the way browsers are lenient: unclosed void
+// elements, HTML entities and attributes without value are accepted. The
+// document is decoded with a non strict XML decoder and written again as well
+// formed XML for xml-dom. The doctype is returned apart as xml-dom does not
+// keep it, followed by a new line.
+func parseHTML(r io.Reader) (doc *xmldom.Node, doctype string, err error) {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	// prefix of each namespace, the decoder resolves them to their URL
+	prefixes := map[string]string{"http://www.w3.org/XML/1998/namespace": "xml"}
+	qname := func(n xml.Name) string {
+		prefix, ok := prefixes[n.Space]
+		if !ok {
+			prefix = n.Space
+		}
+		if prefix == "" {
+			return n.Local
+		}
+		return prefix + ":" + n.Local
+	}
+
+	var buf bytes.Buffer
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			for _, a := range t.Attr {
+				if a.Name.Space == "" && a.Name.Local == "xmlns" {
+					prefixes[a.Value] = ""
+				} else if a.Name.Space == "xmlns" {
+					prefixes[a.Value] = a.Name.Local
+				}
+			}
+			buf.WriteString("<" + qname(t.Name))
+			for _, a := range t.Attr {
+				name := a.Name.Local
+				if a.Name.Space == "xmlns" {
+					name = "xmlns:" + name
+				} else if a.Name.Space != "" {
+					name = qname(a.Name)
+				}
+				buf.WriteString(" " + name + "=\"" + htmlEncode(a.Value) + "\"")
+			}
+			buf.WriteString(">")
+		case xml.EndElement:
+			buf.WriteString("</" + qname(t.Name) + ">")
+		case xml.CharData:
+			buf.WriteString(htmlEncode(string(t)))
+		case xml.Comment:
+			buf.WriteString("<!--" + string(t) + "-->")
+		case xml.ProcInst:
+			if t.Target != "xml" {
+				buf.WriteString("<?" + t.Target + " " + string(t.Inst) + "?>")
+			}
+		case xml.Directive:
+			if strings.HasPrefix(strings.ToUpper(string(t)), "DOCTYPE") && doctype == "" {
+				doctype = "<!" + string(t) + ">\n"
+			}
+		}
+	}
+
+	doc, err = xmldom.ParseXML(&buf)
+	return doc, doctype, err
+}
+
+// File name of a page of the cross product, the file name template of the
+// first pagination is used with ${NAME.num} and ${NAME.idx} for each
+// pagination (latest for the latest page)
+func crossFileName(srcfile string, paginations []*Pagination, states []int) string {
+	all := true
+	for _, state := range states {
+		all = all && state < 0
+	}
+	if all {
+		return srcfile
+	}
+
+	template := paginations[0].FileName
+	if !strings.Contains(template, "${"+paginations[0].Name+".") {
+		template = "${basename}"
+		for _, pagination := range paginations {
+			template += ".${" + pagination.Name + ".num}"
+		}
+		template += ".${ext}"
+	}
+
+	args := fileNameArgs(srcfile, "", template, 0)
+	fname := expandFileName(args)
+	for i, pagination := range paginations {
+		num, idx := "latest", "latest"
+		if states[i] >= 0 {
+			num, idx = strconv.Itoa(states[i]+1), strconv.Itoa(states[i])
+		}
+		fname = strings.Replace(fname, "${"+pagination.Name+".num}", num, -1)
+		fname = strings.Replace(fname, "${"+pagination.Name+".idx}", idx, -1)
+	}
+	return fname
+}
+
 type TemplateArgs struct {
 	template string
+	name     string
+	year     string
+	month    string
 	basename string
 	ext      string
 	num      string
 	idx      string
 }
 
-func fileNameArgs(srcfile, template string, index int) TemplateArgs {
+func fileNameArgs(srcfile, name, template string, index int) TemplateArgs {
 	var args TemplateArgs
 	args.template = template
+	args.name = name
 	args.ext = filepath.Ext(srcfile)
 	args.basename = srcfile[0 : len(srcfile)-len(args.ext)]
 	args.num = strconv.Itoa(index + 1)
@@ -268,13 +636,20 @@ func fileNameArgs(srcfile, template string, index int) TemplateArgs {
 func expandFileName(a TemplateArgs) string {
 	fname := a.template
 	fname = strings.Replace(fname, "${basename}", a.basename, -1)
+	fname = strings.Replace(fname, "${name}", a.name, -1)
 	fname = strings.Replace(fname, "${ext}", a.ext, -1)
 	fname = strings.Replace(fname, "${num}", a.num, -1)
+	fname = strings.Replace(fname, "${pagenum}", a.num, -1)
 	fname = strings.Replace(fname, "${idx}", a.idx, -1)
+	fname = strings.Replace(fname, "${year}", a.year, -1)
+	fname = strings.Replace(fname, "${month}", a.month, -1)
 	return fname
 }
 
-func computePages(pageSize, numItems int) (pages [][]int, lastPage []int) {
+// Pages numbered from the first item, in document order unless reverse is
+// true. The latest page holds the last pageSize items, last item first as in
+// earlier versions, reverse gives the numbered pages the same order.
+func computePages(pageSize, numItems int, reverse bool) (pages [][]int, lastPage []int) {
 	var curPage []int
 	for i := 0; i < numItems; i++ {
 		curPage = append(curPage, i)
@@ -292,103 +667,406 @@ func computePages(pageSize, numItems int) (pages [][]int, lastPage []int) {
 			break
 		}
 	}
+	if reverse {
+		for _, page := range pages {
+			reverseItems(page)
+		}
+	}
 	return
 }
 
+// Pages numbered from the oldest item, in chronological order unless reverse
+// is true. The latest page is a copy of the newest numbered page, which may be
+// partial: both documents show the same items until the page is full.
+func computeStablePages(pageSize, numItems int, newestFirst, reverse bool) (pages [][]int, lastPage []int) {
+	var curPage []int
+	for i := 0; i < numItems; i++ {
+		item := i
+		if newestFirst {
+			item = numItems - 1 - i
+		}
+		curPage = append(curPage, item)
+		if len(curPage) >= pageSize {
+			pages = append(pages, curPage)
+			curPage = nil
+		}
+	}
+	if len(curPage) > 0 {
+		pages = append(pages, curPage)
+	}
+	if reverse {
+		for _, page := range pages {
+			reverseItems(page)
+		}
+	}
+	if len(pages) > 0 {
+		lastPage = append(lastPage, pages[len(pages)-1]...)
+	}
+	return
+}
+
+// Archive pages grouping the items by the year or month of their date, in
+// chronological order. The latest page is the newest archive. Items without a
+// date are an error as they would not be in any archive.
+func computeArchivePages(dates []string, by string, reverse bool) (pages [][]int, keys []string, lastPage []int, err error) {
+	length := 4
+	if by == "month" {
+		length = 7
+	}
+
+	archives := map[string][]int{}
+	for i, date := range dates {
+		date = strings.TrimSpace(date)
+		if len(date) < length {
+			return nil, nil, nil, fmt.Errorf("<pagination by=%#v />: item %d has no date", by, i+1)
+		}
+		key := date[:length]
+		if archives[key] == nil {
+			keys = append(keys, key)
+		}
+		archives[key] = append(archives[key], i)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		page := archives[key]
+		if reverse {
+			reverseItems(page)
+		}
+		pages = append(pages, page)
+	}
+	if len(pages) > 0 {
+		lastPage = append(lastPage, pages[len(pages)-1]...)
+	}
+	return
+}
+
+func reverseItems(items []int) {
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+}
+
 type PageMeta struct {
-	index    int // negative if this is the last page
-	size     int
-	srcfile  string
-	template string
-	head     *xmlpath.Path
+	index     int // negative if this is the last page
+	size      int
+	keys      []string // archive of each page
+	name      string
+	srcfile   string
+	docfile   string // file name of the document being created
+	template  string
+	head      *xpath.Expr
+	duplicate bool                   // the latest page shows the items of the last numbered page
+	canonical bool                   // add the canonical link
+	links     bool                   // add the first, prev, next and last links
+	nav       bool                   // expand <pagination-nav> without for attribute
+	fileOf    func(index int) string // file name of the document showing the page at index instead
+}
+
+// Prefix of the meta and link names, namespaced for named paginations
+func (meta PageMeta) prefix() string {
+	if meta.name == "" {
+		return "pagination"
+	}
+	return "pagination." + meta.name
+}
+
+// Index of the previous page, the latest page comes after the last numbered
+// page, or replaces it if it is a duplicate
+func (meta PageMeta) prev() (int, bool) {
+	if meta.index < 0 && meta.duplicate {
+		return meta.size - 2, meta.size > 1
+	} else if meta.index < 0 {
+		return meta.size - 1, meta.size > 0
+	}
+	return meta.index - 1, meta.index > 0
+}
+
+// Index of the next page, -1 for the latest page after the last numbered page
+// unless it is a duplicate
+func (meta PageMeta) next() (int, bool) {
+	if meta.index < 0 {
+		return 0, false
+	} else if meta.index == meta.size-1 {
+		return -1, !meta.duplicate
+	}
+	return meta.index + 1, true
+}
+
+// Index of the page of the canonical link, the last numbered page for a
+// latest page duplicating it
+func (meta PageMeta) canonicalIndex() int {
+	if meta.index < 0 && meta.duplicate && meta.size > 0 {
+		return meta.size - 1
+	}
+	return meta.index
 }
 
-func createPage(in *xmlpath.NodeRef, forPath, inPath *xmlpath.Path, page []int, meta PageMeta) {
-	var insertionPoint *xmlpath.NodeRef
-	inIt := inPath.Iter(in.Node)
-	nodes := forPath.Iter(in.Node).Nodes()
+// Return true if both pages have the same items, in any order
+func sameItems(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	items := map[int]bool{}
+	for _, i := range a {
+		items[i] = true
+	}
+	for _, i := range b {
+		if !items[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func createPage(in *xmldom.Node, pagination *Pagination, page []int, meta PageMeta) error {
+	var insertionPoint *xmldom.Node
+	nodes := pagination.ForPath.EvaluateNode(in).Nodes()
 
-	if inIt.Next() {
-		insertionPoint = inIt.Node().Ref
+	if points := pagination.InPath.EvaluateNode(in).Nodes(); len(points) > 0 {
+		insertionPoint = points[0]
 	} else if len(nodes) > 0 {
-		insertionPoint = nodes[0].Node.Parent().Ref
+		insertionPoint = nodes[0].ParentNode()
 	}
 	if insertionPoint == nil {
-		return
+		return nil
 	}
 
 	for _, node := range nodes {
-		node.Node.Remove()
+		_, err := node.ParentNode().RemoveChild(node)
+		if err != nil {
+			return err
+		}
 	}
-	//log("insertion point: %#v\n", string(insertionPoint.Node.XML()))
+	//log("insertion point: %#v\n", insertionPoint.XML())
 	for _, i := range page {
-		insertionPoint.Node.InsertLastChild(nodes[i].Node)
-		//log("\nitem %d: %#v\n", i, string(nodes[i].Node.XML()))
-		//log("insertion point %d: %#v\n", i, string(insertionPoint.Node.XML()))
+		_, err := insertionPoint.AppendChild(nodes[i])
+		if err != nil {
+			return err
+		}
+		//log("\nitem %d: %#v\n", i, nodes[i].XML())
 	}
 
-	var head *xmlpath.NodeRef
+	var head *xmldom.Node
+	var markup string
 	if meta.head != nil {
 		log("head: ok\n")
-		it := meta.head.Iter(in.Node)
-		if it.Next() {
-			head = it.Node().Ref
+		if heads := meta.head.EvaluateNode(in).Nodes(); len(heads) > 0 {
+			head = heads[0]
 		}
 	}
 	if head != nil {
-		args := fileNameArgs(meta.srcfile, meta.template, meta.index)
-		head.Node.InsertLastChild(metaNode("pagination", "true"))
+		args := pagination.fileNameArgs(meta.srcfile, meta.index)
+		prefix := meta.prefix()
+		markup += metaNode(prefix, "true")
 		if meta.index < 0 {
-			head.Node.InsertLastChild(metaNode("pagination.latest", "latest"))
+			markup += metaNode(prefix+".latest", "latest")
 		} else {
-			head.Node.InsertLastChild(metaNode("pagination.latest", ""))
-		}
-		log("head: %v\n", string(head.Node.XML()))
-		head.Node.InsertLastChild(metaNode("pagination.pageidx", strconv.Itoa(meta.index)))
-		head.Node.InsertLastChild(metaNode("pagination.pagenum", strconv.Itoa(meta.index+1)))
-		head.Node.InsertLastChild(metaNode("pagination.size", strconv.Itoa(meta.size)))
-		head.Node.InsertLastChild(metaNode("pagination.template", meta.template))
-		head.Node.InsertLastChild(metaNode("pagination.template.num", args.num))
-		head.Node.InsertLastChild(metaNode("pagination.template.idx", args.idx))
-		head.Node.InsertLastChild(metaNode("pagination.template.basename", args.basename))
-		head.Node.InsertLastChild(metaNode("pagination.template.ext", args.ext))
+			markup += metaNode(prefix+".latest", "")
+		}
+		log("head: %v\n", head.XML())
+		markup += metaNode(prefix+".pageidx", strconv.Itoa(meta.index))
+		markup += metaNode(prefix+".pagenum", strconv.Itoa(meta.index+1))
+		markup += metaNode(prefix+".size", strconv.Itoa(meta.size))
+		markup += metaNode(prefix+".template", meta.template)
+		markup += metaNode(prefix+".template.num", args.num)
+		markup += metaNode(prefix+".template.idx", args.idx)
+		markup += metaNode(prefix+".template.basename", args.basename)
+		markup += metaNode(prefix+".template.ext", args.ext)
 		var pages_num []string
 		var pages_idx []string
 		for i := 0; i < meta.size; i++ {
 			pages_num = append(pages_num, strconv.Itoa(i+1))
 			pages_idx = append(pages_idx, strconv.Itoa(i))
 		}
-		head.Node.InsertLastChild(metaNode("pagination.pages.idx", strings.Join(pages_idx, " ")))
-		head.Node.InsertLastChild(metaNode("pagination.pages.num", strings.Join(pages_num, " ")))
+		markup += metaNode(prefix+".pages.idx", strings.Join(pages_idx, " "))
+		markup += metaNode(prefix+".pages.num", strings.Join(pages_num, " "))
 		for i := 0; i < meta.size; i++ {
-			a := args
-			a.idx = strconv.Itoa(i)
-			a.num = strconv.Itoa(i + 1)
-			head.Node.InsertLastChild(linkNode("rel",
-				fmt.Sprintf("pagination.page.idx.%d", i),
-				expandFileName(a)))
-			head.Node.InsertLastChild(linkNode("rel",
-				fmt.Sprintf("pagination.page.num.%d", i+1),
-				expandFileName(a)))
-		}
-		head.Node.InsertLastChild(linkNode("rel", "pagination.page.latest", meta.srcfile))
+			markup += linkNode("rel",
+				fmt.Sprintf("%s.page.idx.%d", prefix, i),
+				meta.fileOf(i))
+			markup += linkNode("rel",
+				fmt.Sprintf("%s.page.num.%d", prefix, i+1),
+				meta.fileOf(i))
+		}
+		markup += linkNode("rel", prefix+".page.latest", meta.fileOf(-1))
+		if meta.keys != nil {
+			key := ""
+			if meta.index >= 0 {
+				key = meta.keys[meta.index]
+			} else if len(meta.keys) > 0 {
+				key = meta.keys[len(meta.keys)-1]
+			}
+			markup += metaNode(prefix+".archive", key)
+			markup += metaNode(prefix+".archives", strings.Join(meta.keys, " "))
+			for i, key := range meta.keys {
+				markup += linkNode("rel", prefix+".archive."+key, meta.fileOf(i))
+			}
+		}
+	} else if heads := defaultHead.EvaluateNode(in).Nodes(); len(heads) > 0 {
+		head = heads[0]
+	}
+
+	if head != nil {
+		for _, l := range standardLinks(meta) {
+			markup += linkNode("rel", l[0], l[1])
+		}
+		children, err := parseFragment(head, markup)
+		if err != nil {
+			return err
+		}
+		for _, n := range children {
+			_, err = head.AppendChild(n)
+			if err != nil {
+				return err
+			}
+		}
 	}
+
+	for _, nav := range navPath.EvaluateNode(in).Nodes() {
+		name, ok := pathString(navFor, nav)
+		if (ok && name == meta.name) || (!ok && meta.nav) {
+			children, err := parseFragment(nav, navNode(nav, meta))
+			if err != nil {
+				return err
+			}
+			for _, n := range children {
+				_, err = nav.ParentNode().InsertBefore(n, nav)
+				if err != nil {
+					return err
+				}
+			}
+			_, err = nav.ParentNode().RemoveChild(nav)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func metaNode(name, content string) *xmlpath.Node {
-	n, err := xmlpath.Parse(bytes.NewReader([]byte(fmt.Sprintf("\t<meta name=\"%s\" content=\"%s\" />\n\t", htmlEncode(name), htmlEncode(content)))))
+var defaultHead = xpath.MustCompile("/html/head")
+var navPath = xpath.MustCompile("//pagination-nav")
+var navFor = xpath.MustCompile("@for")
+var fragmentNodes = xpath.MustCompile("/fragment/node()")
+
+// String value of the first node matched by xp, false if there is none
+func pathString(xp *xpath.Expr, n *xmldom.Node) (string, bool) {
+	nodes := xp.EvaluateNode(n).Nodes()
+	if len(nodes) == 0 {
+		return "", false
+	}
+	return nodes[0].AsText(), true
+}
+
+// Parse markup to nodes ready to be inserted in the document of owner
+func parseFragment(owner *xmldom.Node, markup string) ([]*xmldom.Node, error) {
+	doc, err := xmldom.ParseXML(strings.NewReader("<fragment>" + markup + "</fragment>"))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return n
+	var nodes []*xmldom.Node
+	for _, n := range fragmentNodes.EvaluateNode(doc).Nodes() {
+		n = n.CloneNode(true)
+		err = owner.OwnerDocument().ImportNode(n)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
 }
 
-func linkNode(relrev, relrevval, href string) *xmlpath.Node {
-	n, err := xmlpath.Parse(bytes.NewReader([]byte(fmt.Sprintf("\t<link %s=\"%s\" href=\"%s\" />\n\t", relrev, htmlEncode(relrevval), htmlEncode(href)))))
+// Link to the page at index from the current document
+func pageHref(meta PageMeta, index int) string {
+	href, err := filepath.Rel(filepath.Dir(meta.docfile), meta.fileOf(index))
 	if err != nil {
-		panic(err)
+		return meta.fileOf(index)
+	}
+	return filepath.ToSlash(href)
+}
+
+// rel and href of the canonical, first, last, prev and next links
+func standardLinks(meta PageMeta) [][2]string {
+	var links [][2]string
+	if meta.canonical {
+		links = append(links, [2]string{"canonical", pageHref(meta, meta.canonicalIndex())})
+	}
+	if meta.size == 0 || !meta.links {
+		return links
+	}
+	links = append(links, [2]string{"first", pageHref(meta, 0)})
+	if prev, ok := meta.prev(); ok {
+		links = append(links, [2]string{"prev", pageHref(meta, prev)})
+	}
+	if next, ok := meta.next(); ok {
+		links = append(links, [2]string{"next", pageHref(meta, next)})
+	}
+	links = append(links, [2]string{"last", pageHref(meta, meta.size-1)})
+	return links
+}
+
+var navAttrs = []string{"id", "class", "prev-label", "next-label", "latest-label"}
+
+// Expand <pagination-nav> to a navigation bar, the current page is marked with
+// aria-current="page"
+func navNode(nav *xmldom.Node, meta PageMeta) string {
+	attrs := map[string]string{
+		"class":      "pagination",
+		"prev-label": "Previous",
+		"next-label": "Next",
+	}
+	for _, name := range navAttrs {
+		if val, ok := pathString(xpath.MustCompile("@"+name), nav); ok {
+			attrs[name] = val
+		}
+	}
+
+	link := func(rel, class string, index int, label string) string {
+		res := "<a"
+		if rel != "" {
+			res += fmt.Sprintf(" rel=\"%s\"", rel)
+		}
+		if index == meta.index {
+			class = strings.TrimSpace(class + " current")
+			res += " aria-current=\"page\""
+		}
+		if class != "" {
+			res += fmt.Sprintf(" class=\"%s\"", class)
+		}
+		return res + fmt.Sprintf(" href=\"%s\">%s</a>", htmlEncode(pageHref(meta, index)), htmlEncode(label))
 	}
-	return n
+
+	res := "<nav"
+	if attrs["id"] != "" {
+		res += fmt.Sprintf(" id=\"%s\"", htmlEncode(attrs["id"]))
+	}
+	res += fmt.Sprintf(" class=\"%s\" aria-label=\"Pagination\">", htmlEncode(attrs["class"]))
+	if prev, ok := meta.prev(); ok {
+		res += link("prev", "prev", prev, attrs["prev-label"]) + " "
+	}
+	for i := 0; i < meta.size; i++ {
+		label := strconv.Itoa(i + 1)
+		if meta.keys != nil {
+			label = meta.keys[i]
+		}
+		res += link("", "", i, label) + " "
+	}
+	if next, ok := meta.next(); ok {
+		res += link("next", "next", next, attrs["next-label"]) + " "
+	}
+	if attrs["latest-label"] != "" {
+		res += link("", "latest", -1, attrs["latest-label"])
+	}
+	return strings.TrimSpace(res) + "</nav>"
+}
+
+func metaNode(name, content string) string {
+	return fmt.Sprintf("\t<meta name=\"%s\" content=\"%s\" />\n\t", htmlEncode(name), htmlEncode(content))
+}
+
+func linkNode(relrev, relrevval, href string) string {
+	return fmt.Sprintf("\t<link %s=\"%s\" href=\"%s\" />\n\t", relrev, htmlEncode(relrevval), htmlEncode(href))
 }
 
 func htmlEncode(str string) string {
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestComputeArchivePages(t *testing.T) {
+	dates := []string{"2020-05-01", "2019-12-31", " 2020-01-02 ", "2020-05-30"}
+	for _, c := range []struct {
+		by       string
+		reverse  bool
+		pages    [][]int
+		keys     []string
+		lastPage []int
+	}{
+		{"year", false, [][]int{{1}, {0, 2, 3}}, []string{"2019", "2020"}, []int{0, 2, 3}},
+		{"year", true, [][]int{{1}, {3, 2, 0}}, []string{"2019", "2020"}, []int{3, 2, 0}},
+		{"month", false, [][]int{{1}, {2}, {0, 3}}, []string{"2019-12", "2020-01", "2020-05"}, []int{0, 3}},
+	} {
+		pages, keys, lastPage, err := computeArchivePages(dates, c.by, c.reverse)
+		if err != nil {
+			t.Errorf("by %s: %v", c.by, err)
+			continue
+		}
+		if !reflect.DeepEqual(pages, c.pages) || !reflect.DeepEqual(keys, c.keys) || !reflect.DeepEqual(lastPage, c.lastPage) {
+			t.Errorf("by %s reverse %v: got %v %v %v, want %v %v %v", c.by, c.reverse, pages, keys, lastPage, c.pages, c.keys, c.lastPage)
+		}
+	}
+
+	pages, keys, lastPage, err := computeArchivePages(nil, "year", false)
+	if err != nil || pages != nil || keys != nil || lastPage != nil {
+		t.Errorf("no items: got %v %v %v %v", pages, keys, lastPage, err)
+	}
+}
+
+func TestComputeArchivePagesUndated(t *testing.T) {
+	for _, c := range []struct {
+		by    string
+		dates []string
+		item  string
+	}{
+		{"year", []string{"2020-01-01", "", "2021-01-01"}, "item 2 "},
+		{"year", []string{"   "}, "item 1 "},
+		{"month", []string{"2020-01-01", "2020"}, "item 2 "},
+	} {
+		_, _, _, err := computeArchivePages(c.dates, c.by, false)
+		if err == nil || !strings.Contains(err.Error(), c.item) {
+			t.Errorf("by %s %q: got error %v, want %q", c.by, c.dates, err, c.item)
+		}
+	}
+}
+
+func TestComputeStablePages(t *testing.T) {
+	for _, c := range []struct {
+		newestFirst, reverse bool
+		pages                [][]int
+		lastPage             []int
+	}{
+		{false, false, [][]int{{0, 1}, {2, 3}, {4}}, []int{4}},
+		{false, true, [][]int{{1, 0}, {3, 2}, {4}}, []int{4}},
+		{true, false, [][]int{{4, 3}, {2, 1}, {0}}, []int{0}},
+		{true, true, [][]int{{3, 4}, {1, 2}, {0}}, []int{0}},
+	} {
+		pages, lastPage := computeStablePages(2, 5, c.newestFirst, c.reverse)
+		if !reflect.DeepEqual(pages, c.pages) || !reflect.DeepEqual(lastPage, c.lastPage) {
+			t.Errorf("newestFirst %v reverse %v: got %v %v, want %v %v", c.newestFirst, c.reverse, pages, lastPage, c.pages, c.lastPage)
+		}
+	}
+}
+
+// Adding an item must only change the newest page: the numbered pages keep the
+// same items, counted from the oldest item whatever the document order
+func TestComputeStablePagesStability(t *testing.T) {
+	const pageSize = 3
+	for _, newestFirst := range []bool{false, true} {
+		for _, reverse := range []bool{false, true} {
+			var prev [][]int
+			for n := 1; n <= 10; n++ {
+				pages, lastPage := computeStablePages(pageSize, n, newestFirst, reverse)
+				chrono := make([][]int, len(pages))
+				for i, page := range pages {
+					for _, item := range page {
+						if newestFirst {
+							item = n - 1 - item
+						}
+						chrono[i] = append(chrono[i], item)
+					}
+				}
+				for i := 0; i+1 < len(prev); i++ {
+					if !reflect.DeepEqual(chrono[i], prev[i]) {
+						t.Errorf("newestFirst %v reverse %v, %d items: page %d changed from %v to %v", newestFirst, reverse, n, i, prev[i], chrono[i])
+					}
+				}
+				if !reflect.DeepEqual(lastPage, pages[len(pages)-1]) {
+					t.Errorf("newestFirst %v reverse %v, %d items: latest page %v, want %v", newestFirst, reverse, n, lastPage, pages[len(pages)-1])
+				}
+				prev = chrono
+			}
+		}
+	}
+}
+
+func TestComputePages(t *testing.T) {
+	pages, lastPage := computePages(2, 5, false)
+	if want := [][]int{{0, 1}, {2, 3}, {4}}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("got pages %v, want %v", pages, want)
+	}
+	if want := []int{4, 3}; !reflect.DeepEqual(lastPage, want) {
+		t.Errorf("got latest page %v, want %v", lastPage, want)
+	}
+
+	pages, lastPage = computePages(2, 5, true)
+	if want := [][]int{{1, 0}, {3, 2}, {4}}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("reverse: got pages %v, want %v", pages, want)
+	}
+	if want := []int{4, 3}; !reflect.DeepEqual(lastPage, want) {
+		t.Errorf("reverse: got latest page %v, want %v", lastPage, want)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mildred/htmltools/parser"
+	"github.com/mildred/xml-dom"
+	"github.com/mildred/xml-dom/xpath"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var compareOps = []string{"eq", "ne", "lt", "le", "gt", "ge"}
+
+// Evaluate the condition of the <if> or <unless> directive at p on the source
+// node in. The condition is either the test xpath, or the text of the value
+// xpath compared to the eq, ne, lt, le, gt and ge attributes.
+func evalCondition(p *parser.Parser, in *xmldom.Node, scope *Scope, namespaces map[string]string) (bool, error) {
+	var res bool
+	if test := p.Attr("test"); test != nil {
+		path, err := scope.compile(test.Val, in, namespaces)
+		if err != nil {
+			return false, err
+		}
+		res = truth(path.Evaluate(in))
+	} else if value := p.Attr("value"); value != nil {
+		path, err := scope.compile(value.Val, in, namespaces)
+		if err != nil {
+			return false, err
+		}
+		res = compareValue(string(nodesToText(IterNodes(path, in))), p)
+	} else {
+		return false, fmt.Errorf("Missing test or value attribute in <%s>", p.Data())
+	}
+
+	if p.Data() == "unless" {
+		res = !res
+	}
+	return res, nil
+}
+
+// Boolean value of an xpath result
+func truth(res interface{}) bool {
+	switch val := res.(type) {
+	case nil:
+		return false
+	case bool:
+		return val
+	case float64:
+		return val != 0 && !math.IsNaN(val)
+	case string:
+		return val != ""
+	case *xpath.Iterator:
+		return val.MoveNext()
+	default:
+		return fmt.Sprint(val) != ""
+	}
+}
+
+// Compare val to the operands of the comparison attributes, numerically if
+// both are numbers. Without comparison, val must not be empty.
+func compareValue(val string, p *parser.Parser) bool {
+	found := false
+	for _, op := range compareOps {
+		attr := p.Attr(op)
+		if attr == nil {
+			continue
+		}
+		operand := attr.Val
+		found = true
+
+		var c int
+		a, erra := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		b, errb := strconv.ParseFloat(strings.TrimSpace(operand), 64)
+		if erra == nil && errb == nil {
+			if a < b {
+				c = -1
+			} else if a > b {
+				c = 1
+			}
+		} else {
+			c = strings.Compare(val, operand)
+		}
+
+		var ok bool
+		switch op {
+		case "eq":
+			ok = c == 0
+		case "ne":
+			ok = c != 0
+		case "lt":
+			ok = c < 0
+		case "le":
+			ok = c <= 0
+		case "gt":
+			ok = c > 0
+		case "ge":
+			ok = c >= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return found || val != ""
+}
+
+// Split the content of a condition in the directives run when it holds and
+// the content of its <else> child
+func splitElse(content []byte) (then, els []byte, err error) {
+	pp := parser.NewParser(bytes.NewReader(content))
+	for {
+		err = pp.Next()
+		if err == io.EOF {
+			return then, els, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		if pp.Depth() == 1 && pp.IsStartTag() && pp.Data() == "else" {
+			data, err := pp.RawContent()
+			if err != nil {
+				return nil, nil, err
+			}
+			els = append(els, data...)
+			continue
+		}
+
+		then = append(then, pp.Raw()...)
+	}
+}
+
+// Remove the template nodes found by the xpath expression
+func removeNodes(tmpl *xmldom.Node, expr string, scope *Scope, namespaces map[string]string) error {
+	path, err := scope.compile(expr, tmpl, namespaces)
+	if err != nil {
+		return err
+	}
+	for _, n := range path.EvaluateNode(tmpl).Nodes() {
+		if n.ParentNode() == nil {
+			log("   cannot remove %#v without parent\n", n.XML())
+			continue
+		}
+		_, err = n.ParentNode().RemoveChild(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/mildred/xml-dom"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Object with its members in order
+type object []member
+
+type member struct {
+	Key string
+	Val interface{}
+}
+
+// Type of a data source from its file extension
+func sourceType(fname string) string {
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	case ".csv":
+		return "csv"
+	default:
+		return "xml"
+	}
+}
+
+// Parse a data source to a DOM. Structured data (json, yaml, toml or csv) is
+// mapped to a <data> element, objects members are child elements named after
+// the key and arrays repeat the element of their member. The type is guessed
+// from the file name if empty.
+func parseSource(fname, typ string, r io.Reader) (*xmldom.Node, error) {
+	if typ == "" {
+		typ = sourceType(fname)
+	}
+	if typ == "xml" || typ == "html" {
+		return xmldom.ParseXML(r)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	switch typ {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		v, err = decodeJSON(dec)
+	case "yaml":
+		err = yaml.Unmarshal(data, &v)
+		v = normalize(v)
+	case "toml":
+		var m map[string]interface{}
+		err = toml.Unmarshal(data, &m)
+		v = normalize(m)
+	case "csv":
+		v, err = decodeCSV(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("Unknown data source type %#v", typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+
+	var buf bytes.Buffer
+	writeItem(&buf, "data", v)
+	log("Data source %s as %s: %s\n", fname, typ, buf.String())
+	return xmldom.ParseXML(&buf)
+}
+
+// Decode a JSON value keeping the order of the object members
+func decodeJSON(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		var obj object
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			val, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, member{key.(string), val})
+		}
+		_, err = dec.Token()
+		return obj, err
+	case json.Delim('['):
+		var list []interface{}
+		for dec.More() {
+			val, err := decodeJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, val)
+		}
+		_, err = dec.Token()
+		return list, err
+	default:
+		return tok, nil
+	}
+}
+
+// Records of a CSV file as <row> elements, the first line gives the names
+// of the columns
+func decodeCSV(r io.Reader) (interface{}, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil || len(records) == 0 {
+		return object{}, err
+	}
+	var rows []interface{}
+	for _, record := range records[1:] {
+		var row object
+		for i, val := range record {
+			if i < len(records[0]) {
+				row = append(row, member{records[0][i], val})
+			}
+		}
+		rows = append(rows, row)
+	}
+	return object{{"row", rows}}, nil
+}
+
+// Convert decoded maps to objects with sorted keys
+func normalize(v interface{}) interface{} {
+	var obj object
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for key, item := range val {
+			obj = append(obj, member{key, normalize(item)})
+		}
+	case map[interface{}]interface{}:
+		for key, item := range val {
+			obj = append(obj, member{fmt.Sprint(key), normalize(item)})
+		}
+	case []map[string]interface{}:
+		var list []interface{}
+		for _, item := range val {
+			list = append(list, normalize(item))
+		}
+		return list
+	case []interface{}:
+		var list []interface{}
+		for _, item := range val {
+			list = append(list, normalize(item))
+		}
+		return list
+	default:
+		return v
+	}
+	sort.Slice(obj, func(i, j int) bool { return obj[i].Key < obj[j].Key })
+	return obj
+}
+
+func isNameChar(c rune, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(!first && (c == '-' || c == '.' || (c >= '0' && c <= '9')))
+}
+
+// Element name for a key, keys that are not valid names give <item key="...">
+func elementName(key string) (string, bool) {
+	if key == "" || strings.HasPrefix(strings.ToLower(key), "xml") {
+		return "item", false
+	}
+	for i, c := range key {
+		if !isNameChar(c, i == 0) {
+			return "item", false
+		}
+	}
+	return key, true
+}
+
+func scalarText(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case time.Time:
+		return val.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// Write the member key, arrays give an element per item
+func writeValue(buf *bytes.Buffer, key string, v interface{}) {
+	if list, ok := v.([]interface{}); ok {
+		for _, item := range list {
+			writeItem(buf, key, item)
+		}
+		return
+	}
+	writeItem(buf, key, v)
+}
+
+func writeItem(buf *bytes.Buffer, key string, v interface{}) {
+	name, ok := elementName(key)
+	buf.WriteString("<" + name)
+	if !ok {
+		buf.WriteString(` key="`)
+		xml.EscapeText(buf, []byte(key))
+		buf.WriteString(`"`)
+	}
+	buf.WriteString(">")
+	switch val := v.(type) {
+	case object:
+		for _, m := range val {
+			writeValue(buf, m.Key, m.Val)
+		}
+	case []interface{}:
+		for _, item := range val {
+			writeItem(buf, "item", item)
+		}
+	default:
+		xml.EscapeText(buf, []byte(scalarText(val)))
+	}
+	buf.WriteString("</" + name + ">")
+}
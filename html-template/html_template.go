@@ -17,6 +17,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 )
 
 var verbose bool = false
@@ -120,6 +121,7 @@ func handleTags(curdir string, r io.Reader, w io.Writer) error {
 	}
 
 	var templates map[string][]byte = map[string][]byte{}
+	var mappings map[string][]byte = map[string][]byte{}
 	p := parser.NewParser(r)
 	for {
 
@@ -143,10 +145,22 @@ func handleTags(curdir string, r io.Reader, w io.Writer) error {
 			}
 		}
 
+		if p.IsStartTag() && p.Data() == "mapping" {
+			id := p.Attr("id")
+			if id != nil {
+				mappings[id.Val], err = p.RawContent()
+				if err != nil {
+					return err
+				}
+				raw = nil
+			}
+		}
+
 		if p.IsStartTag() && p.Data() == "template-instance" {
 
 			//log("template-instance: %v\n", string(raw))
 			src := p.AttrVal("src", "")
+			srcType := p.AttrVal("type", "")
 			using := p.Attr("using")
 			ifClause := p.AttrVal("if", "")
 
@@ -186,7 +200,7 @@ func handleTags(curdir string, r io.Reader, w io.Writer) error {
 					if err != nil {
 						return err
 					}
-					raw, err = evalTemplate(curdir, src, r2, template, mapping, raw, ifClause)
+					raw, err = evalTemplate(curdir, src, srcType, r2, template, mapping, mappings, raw, ifClause)
 				} else {
 					srcfile := src
 					if !filepath.IsAbs(srcfile) {
@@ -199,7 +213,7 @@ func handleTags(curdir string, r io.Reader, w io.Writer) error {
 					}
 					defer sf.Close()
 
-					raw, err = evalTemplate(curdir, src, sf, template, mapping, raw, ifClause)
+					raw, err = evalTemplate(curdir, src, srcType, sf, template, mapping, mappings, raw, ifClause)
 				}
 				if err != nil {
 					return err
@@ -225,12 +239,15 @@ var (
 // curdir:   directory where the template file is
 // src:      data source relative to curdir (empty denotes the file being
 //           templated)
+// srcType:  data source type (xml, json, yaml, toml or csv), guessed from src
+//           if empty
 // sf:       data source reader
 // template: the content of the <template/> tag
 // mapping:  the content of the <template-instance/> tag
+// mappings: the named <mapping/> blocks
 // raw:      ...
 // ifClause: ...
-func evalTemplate(curdir, src string, sf io.Reader, template, mapping, raw []byte, ifClause string) ([]byte, error) {
+func evalTemplate(curdir, src, srcType string, sf io.Reader, template, mapping []byte, mappings map[string][]byte, raw []byte, ifClause string) ([]byte, error) {
 	var err error
 	var in, t *xmldom.Node
 	// in: XML DOM for sf
@@ -243,7 +260,7 @@ func evalTemplate(curdir, src string, sf io.Reader, template, mapping, raw []byt
 		return nil, err
 	}
 
-	in, err = xmldom.ParseXML(sf)
+	in, err = parseSource(src, srcType, sf)
 	if err != nil {
 		return nil, err
 	}
@@ -260,7 +277,8 @@ func evalTemplate(curdir, src string, sf io.Reader, template, mapping, raw []byt
 	}
 
 	var sortk SortKeys
-	err = runTemplate(curdir, src, p, in, t, &sortk)
+	scope := &Scope{Mappings: mappings}
+	err = runTemplate(curdir, src, p, in, t, &sortk, scope)
 	if err != nil && err != io.EOF {
 		logv("Error: %#v\n", err)
 		return nil, err
@@ -354,10 +372,13 @@ func IterNodes(xp *xpath.Expr, n *xmldom.Node) []*xmldom.Node {
 // in:       DOM for the data source (src)
 // tmpl:     DOM for the template markup (the content of the <template/> tag)
 // sortk:    Sort key list for collections
-func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xmldom.Node, sortk *SortKeys) error {
+// scope:    variables and named mappings, the variables defined in this block
+//           are not visible from the parent block
+func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xmldom.Node, sortk *SortKeys, scope *Scope) error {
 	logIndent()
 	defer logDeIndent()
 	depth := p.Depth()
+	scope = scope.child()
 	//ownerdoc := xmldom.NewDocument()
 
 	log("\n[%d] Templating in file %#v\nfrom source data: %#v\nusing template: %#v\n\n", depth, string(src), in.XML(), tmpl.XML())
@@ -394,7 +415,7 @@ func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xm
 				continue
 			}
 
-			path, err := xpath.CompileNS(pathStr, namespaces)
+			path, err := scope.compile(pathStr, in, namespaces)
 			if err != nil {
 				return err
 			}
@@ -419,17 +440,37 @@ func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xm
 			var frompath, topath *xpath.Expr
 			from := p.Attr("from")
 			to := p.Attr("to")
+			attr := p.AttrVal("attr", "")
+			mode := p.AttrVal("mode", "replace")
+			separator := p.AttrVal("separator", " ")
 			dataattr := p.Attr("data")
 			format := p.Attr("format")
 			multi := p.Attr("multiple")
 			fetch := p.Attr("fetch")
+			fetchType := p.AttrVal("type", "")
 			onlyif := p.Attr("only-if")
 
 			log("[%d]   source context:   %v\n", depth, in.XML())
 			log("[%d]   template context: %v\n", depth, tmpl.XML())
 
+			var toStr string
 			if to != nil {
-				topath, err = xpath.CompileNS(to.Val, namespaces)
+				toStr = to.Val
+			}
+			if attr == "" {
+				toStr, attr = splitAttrPath(toStr)
+			}
+			if attr != "" && !attrNameRe.MatchString(attr) {
+				return fmt.Errorf("Invalid attribute name %#v", attr)
+			}
+			if mode != "replace" && mode != "append" && mode != "prepend" {
+				return fmt.Errorf("Invalid mode %#v, expected replace, append or prepend", mode)
+			}
+			if toStr == "" && attr != "" {
+				toStr = "."
+			}
+			if toStr != "" {
+				topath, err = scope.compile(toStr, tmpl, namespaces)
 				if err != nil {
 					return err
 				}
@@ -439,8 +480,12 @@ func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xm
 				i := topath.EvaluateNode(tmpl)
 				empty := true
 				for i.Next() {
-					if path_children.Exists(i.Node()) {
-						log("[%d]   only-if=empty: skip because %v is not empty\n", depth, to.Val)
+					val, err := attrValue(i.Node(), attr)
+					if err != nil {
+						return err
+					}
+					if val != "" || (attr == "" && path_children.Exists(i.Node())) {
+						log("[%d]   only-if=empty: skip because %v is not empty\n", depth, toStr)
 						empty = false
 						break
 					}
@@ -448,11 +493,11 @@ func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xm
 				if !empty {
 					continue
 				}
-				log("[%d]   only-if=empty: continue because %v is empty\n", depth, to.Val)
+				log("[%d]   only-if=empty: continue because %v is empty\n", depth, toStr)
 			}
 
 			if from != nil {
-				frompath, err = xpath.CompileNS(from.Val, namespaces)
+				frompath, err = scope.compile(from.Val, in, namespaces)
 				if err != nil {
 					return err
 				}
@@ -520,13 +565,13 @@ func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xm
 							return err
 						}
 						defer sf.Close()
-						in, err := xmldom.ParseXML(sf)
+						in, err := parseSource(newsrcfile, fetchType, sf)
 						if err != nil {
 							return fmt.Errorf("%s: %v", newsrcfile, err)
 						}
 
 						pp := parser.NewParser(bytes.NewReader(submap))
-						err = runTemplate(curdir, newsrc, pp, in, n, &sort2)
+						err = runTemplate(curdir, newsrc, pp, in, n, &sort2, scope)
 						if err != nil && err != io.EOF {
 							log("[%d] Fetch resource error: %v\n", depth, err)
 							return err
@@ -554,14 +599,21 @@ func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xm
 				nodes = nil
 			} else if topath != nil && nodes != nil {
 				// FIXME: set xml:base
-				log("[%d] evaluate topath=%s, %s\n", depth, to.Val, topath.DebugString())
+				log("[%d] evaluate topath=%s, %s\n", depth, toStr, topath.DebugString())
 				log("[%d] multiple=%v\n", depth, multi)
 				matches := topath.EvaluateNode(tmpl).Nodes()
-				log("[%d] %d to matches: %#v\n", depth, len(matches), to.Val)
+				log("[%d] %d to matches: %#v\n", depth, len(matches), toStr)
 				log("[%d] . in template: %s\n", depth, tmpl.XML())
 				for _, tnode := range matches {
 
-					if multi != nil && multi.Val == "true" {
+					if attr != "" && tnode.NodeType() == xmldom.ElementNode {
+						log("[%d] Set attribute %s (%s)\n", depth, attr, mode)
+						err := setAttribute(tnode, attr, string(nodesToText(nodes)), mode, separator)
+						if err != nil {
+							return err
+						}
+
+					} else if multi != nil && multi.Val == "true" {
 						log("[%d] Multiple (%d) templating of %#v\n", depth, len(nodes), tnode.XML())
 						submap, err := p.RawContent()
 						if err != nil {
@@ -574,7 +626,7 @@ func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xm
 							//log(" before %#v\n", string(tnode.Node.XML()))
 							pp := parser.NewParser(bytes.NewReader(submap))
 							var sort2 SortKeys
-							err = runTemplate(curdir, src, pp, inode, n, &sort2)
+							err = runTemplate(curdir, src, pp, inode, n, &sort2, scope)
 							if err != nil && err != io.EOF {
 								log("[%d] Multiple templating error %v\n", depth, err)
 								return err
@@ -608,7 +660,12 @@ func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xm
 							log("[%d] %d --> %#v\n", i, depth, nodes[i].XML())
 							children = append(children, nodes[i])
 						}
-						err := ReplaceInner(tnode, children)
+						var err error
+						if mode == "append" || mode == "prepend" {
+							err = InsertInner(tnode, children, mode == "prepend")
+						} else {
+							err = ReplaceInner(tnode, children)
+						}
 						if err != nil {
 							panic(err)
 						}
@@ -616,7 +673,7 @@ func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xm
 
 					} else {
 						log("[%d] Convert %d nodes to text\n", depth, len(nodes))
-						tnode.SetNodeValue(string(nodesToText(nodes)))
+						tnode.SetNodeValue(joinValue(tnode.AsText(), string(nodesToText(nodes)), mode, separator))
 					}
 
 				}
@@ -624,6 +681,64 @@ func runTemplate(curdir, src string, p *parser.Parser, in *xmldom.Node, tmpl *xm
 			} else {
 				log("\n[%d] Mapping Aborted\n", depth)
 			}
+		} else if p.IsStartTag() && (p.Data() == "if" || p.Data() == "unless") {
+			log("\n[%d] Condition: %v\n", depth, string(p.Token().String()))
+			ok, err := evalCondition(p, in, scope, namespaces)
+			if err != nil {
+				return err
+			}
+			remove := p.Attr("remove")
+
+			content, err := p.RawContent()
+			if err != nil {
+				return err
+			}
+			then, els, err := splitElse(content)
+			if err != nil {
+				return err
+			}
+
+			log("[%d]   condition is %v\n", depth, ok)
+			branch := then
+			if !ok {
+				branch = els
+				if remove != nil {
+					err = removeNodes(tmpl, remove.Val, scope, namespaces)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			if len(branch) > 0 {
+				pp := parser.NewParser(bytes.NewReader(branch))
+				err = runTemplate(curdir, src, pp, in, tmpl, sortk, scope)
+				if err != nil && err != io.EOF {
+					return err
+				}
+			}
+			log("\n[%d] Condition Result: %#v\n", depth, tmpl.XML())
+		} else if p.IsStartTag() && p.Data() == "let" {
+			err = scope.let(p, in, namespaces)
+			if err != nil {
+				return err
+			}
+		} else if p.IsStartTag() && p.Data() == "mapping" {
+			ref := p.AttrVal("ref", "")
+			block, ok := scope.Mappings[ref]
+			if !ok {
+				return fmt.Errorf("Unknown mapping %#v", ref)
+			} else if scope.active[ref] {
+				return fmt.Errorf("Recursive mapping %#v", ref)
+			}
+			log("\n[%d] Use mapping %#v\n", depth, ref)
+			sub := scope.child()
+			sub.active[ref] = true
+			pp := parser.NewParser(bytes.NewReader(block))
+			err = runTemplate(curdir, src, pp, in, tmpl, sortk, sub)
+			if err != nil && err != io.EOF {
+				return err
+			}
 		} else if p.IsStartTag() || p.IsEndTag() {
 			log("[%d] %s", depth, p.Token().String())
 		} else {
@@ -654,6 +769,90 @@ func ReplaceInner(n *xmldom.Node, newChildren []*xmldom.Node) error {
 	return nil
 }
 
+// Add the children at the end of n, or at the beginning if prepend is true
+func InsertInner(n *xmldom.Node, newChildren []*xmldom.Node, prepend bool) error {
+	first := n.FirstChild()
+	for _, cn := range newChildren {
+		cn = cn.CloneNode(true)
+		err := n.OwnerDocument().ImportNode(cn)
+		if err != nil {
+			return err
+		}
+		if prepend && first != nil {
+			_, err = n.InsertBefore(cn, first)
+		} else {
+			_, err = n.AppendChild(cn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var attrNameRe = regexp.MustCompile(`^[A-Za-z_][\w.:-]*$`)
+
+// A relative location path of simple steps (a, ., .., *, ns:a, child::a with
+// predicates) followed by an attribute step
+var attrPathRe = regexp.MustCompile(`^(?:((?:[\w.:*-]+(?:\[[^\[\]]*\])*)(?:/[\w.:*-]+(?:\[[^\[\]]*\])*)*)/)?@([A-Za-z_][\w.:-]*)$`)
+
+// Split a path to an attribute (a/@href) in the path to the element and the
+// attribute name, so the attribute can be created if missing. Other paths
+// (//@href, a//@href, unions) are kept whole and only set the attributes they
+// find.
+func splitAttrPath(to string) (string, string) {
+	m := attrPathRe.FindStringSubmatch(to)
+	if m == nil {
+		return to, ""
+	}
+	return m[1], m[2]
+}
+
+// New value of a text or attribute for the mode replace, append or prepend
+func joinValue(old, val, mode, separator string) string {
+	if old == "" || val == "" {
+		if mode == "append" || mode == "prepend" {
+			return old + val
+		}
+		return val
+	}
+	switch mode {
+	case "append":
+		return old + separator + val
+	case "prepend":
+		return val + separator + old
+	default:
+		return val
+	}
+}
+
+// Value of the attribute name of n, empty if there is no such attribute. The
+// attribute is matched by its qualified name (xlink:href) so prefixes need no
+// namespace declaration.
+func attrValue(n *xmldom.Node, name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	path, err := xpath.Compile("@*[name()=" + xpathLiteral(name) + "]")
+	if err != nil {
+		return "", err
+	}
+	return string(nodesToText(IterNodes(path, n))), nil
+}
+
+func setAttribute(n *xmldom.Node, name, val, mode, separator string) error {
+	var old string
+	if mode == "append" || mode == "prepend" {
+		var err error
+		old, err = attrValue(n, name)
+		if err != nil {
+			return err
+		}
+	}
+	n.SetAttribute(name, joinValue(old, val, mode, separator))
+	return nil
+}
+
 type AttrsInterface interface {
 	AttrVal(name, defVal string) string
 }
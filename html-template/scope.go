@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mildred/htmltools/parser"
+	"github.com/mildred/xml-dom"
+	"github.com/mildred/xml-dom/xpath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Definitions visible to the directives: the variables defined by <let> and
+// the named <mapping> blocks
+type Scope struct {
+	// xpath substituted to $name, node sets are the absolute paths of
+	// their nodes
+	Vars map[string]string
+	// document of the node set variables, the only one their paths can be
+	// used on
+	Docs     map[string]*xmldom.Node
+	Mappings map[string][]byte
+	// mappings being run, to detect recursion
+	active map[string]bool
+}
+
+var varRe = regexp.MustCompile(`^\$([A-Za-z_]\w*)`)
+
+// Scope for a nested block, its variables are not visible from the parent
+func (scope *Scope) child() *Scope {
+	res := &Scope{
+		Vars:     map[string]string{},
+		Docs:     map[string]*xmldom.Node{},
+		Mappings: scope.Mappings,
+		active:   map[string]bool{},
+	}
+	for name, val := range scope.Vars {
+		res.Vars[name] = val
+	}
+	for name, doc := range scope.Docs {
+		res.Docs[name] = doc
+	}
+	for name := range scope.active {
+		res.active[name] = true
+	}
+	return res
+}
+
+// Substitute the variables in an xpath expression to be evaluated on the node
+// ctx, string literals are left untouched. Node set variables of another
+// document are an error.
+func (scope *Scope) expand(expr string, ctx *xmldom.Node) (string, error) {
+	var res bytes.Buffer
+	var quote byte
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+		} else if c == '"' || c == '\'' {
+			quote = c
+		} else if m := varRe.FindStringSubmatch(expr[i:]); m != nil {
+			if val, ok := scope.Vars[m[1]]; ok {
+				if doc := scope.Docs[m[1]]; doc != nil && doc != ownerDocument(ctx) {
+					return "", fmt.Errorf("Variable $%s holds nodes of another document than the one %#v is evaluated on", m[1], expr)
+				}
+				res.WriteString(val)
+				i += len(m[0]) - 1
+				continue
+			}
+		}
+		res.WriteByte(c)
+	}
+	return res.String(), nil
+}
+
+// Compile an xpath expression to be evaluated on the node ctx
+func (scope *Scope) compile(expr string, ctx *xmldom.Node, namespaces map[string]string) (*xpath.Expr, error) {
+	expanded, err := scope.expand(expr, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return xpath.CompileNS(expanded, namespaces)
+}
+
+// Define the variable of the <let> directive at p, evaluated on in. Node sets
+// are bound to the nodes found, as the union of their absolute paths in the
+// document of in, and can only be used on that document.
+func (scope *Scope) let(p *parser.Parser, in *xmldom.Node, namespaces map[string]string) error {
+	name := p.AttrVal("name", "")
+	if m := varRe.FindString("$" + name); m == "" || m[1:] != name {
+		return fmt.Errorf("Invalid variable name %#v in <let>", name)
+	}
+
+	path, err := scope.compile(p.AttrVal("from", ""), in, namespaces)
+	if err != nil {
+		return err
+	}
+
+	delete(scope.Docs, name)
+
+	switch val := path.Evaluate(in).(type) {
+	case *xpath.Iterator:
+		var paths []string
+		for _, n := range path.EvaluateNode(in).Nodes() {
+			paths = append(paths, nodePath(n))
+		}
+		if len(paths) == 0 {
+			scope.Vars[name] = "/.."
+		} else {
+			scope.Vars[name] = "(" + strings.Join(paths, " | ") + ")"
+		}
+		scope.Docs[name] = ownerDocument(in)
+	case bool:
+		scope.Vars[name] = fmt.Sprintf("%v()", val)
+	case float64:
+		scope.Vars[name] = strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		scope.Vars[name] = xpathLiteral(fmt.Sprint(val))
+	}
+	log("   let $%s = %s\n", name, scope.Vars[name])
+	return nil
+}
+
+// Document of n, n itself for a document
+func ownerDocument(n *xmldom.Node) *xmldom.Node {
+	if doc := n.OwnerDocument(); doc != nil {
+		return doc
+	}
+	return n
+}
+
+var (
+	path_parent   = xpath.MustCompile("..")
+	path_isAttr   = xpath.MustCompile("count(. | ../@*) = count(../@*)")
+	path_name     = xpath.MustCompile("name()")
+	path_position = xpath.MustCompile("count(preceding-sibling::node()) + 1")
+)
+
+// Absolute location path designating n in its document
+func nodePath(n *xmldom.Node) string {
+	var steps []string
+	for {
+		parents := path_parent.EvaluateNode(n).Nodes()
+		if len(parents) == 0 {
+			break
+		}
+		if path_isAttr.Evaluate(n) == true {
+			steps = append(steps, "@*[name()="+xpathLiteral(fmt.Sprint(path_name.Evaluate(n)))+"]")
+		} else {
+			steps = append(steps, fmt.Sprintf("node()[%v]", path_position.Evaluate(n)))
+		}
+		n = parents[0]
+	}
+	for i, j := 0, len(steps)-1; i < j; i, j = i+1, j-1 {
+		steps[i], steps[j] = steps[j], steps[i]
+	}
+	return "/" + strings.Join(steps, "/")
+}
+
+func xpathLiteral(s string) string {
+	if !strings.Contains(s, `"`) {
+		return `"` + s + `"`
+	} else if !strings.Contains(s, "'") {
+		return "'" + s + "'"
+	}
+	return `concat("` + strings.Replace(s, `"`, `", '"', "`, -1) + `")`
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Typed link graph of a site
+type Graph struct {
+	Nodes []*Node `json:"nodes"`
+	Edges []Edge  `json:"edges"`
+}
+
+// A page of the site
+type Node struct {
+	Id    string `json:"id"`
+	Title string `json:"title,omitempty"`
+	// false for pages linked but not part of the walked files
+	Exists bool `json:"exists"`
+}
+
+// A <link rel|rev href> or <a rel href> from Source to Target
+type Edge struct {
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	Direction string `json:"direction"`
+	Kind      string `json:"kind"`
+}
+
+func graphMain(args []string) error {
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	format := flags.String("format", "json", "Output format: json, graphml or dot")
+	output := flags.String("o", "", "Write the graph to this file instead of stdout")
+	aRel := flags.String("a-rel", "", "Comma separated rel values of <a> elements in the body also treated as links")
+	flags.Parse(args)
+	setAnchorRels(*aRel)
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"."}
+	}
+
+	g, err := readGraph(files)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch *format {
+	case "json":
+		return g.WriteJSON(w)
+	case "graphml":
+		return g.WriteGraphML(w)
+	case "dot":
+		return g.WriteDOT(w)
+	default:
+		return fmt.Errorf("Unknown graph format %#v", *format)
+	}
+}
+
+// Walk the files and directories for HTML pages
+func walkFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		err := filepath.Walk(arg, func(fname string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			switch strings.ToLower(filepath.Ext(fname)) {
+			case ".html", ".htm", ".xhtml":
+				files = append(files, fname)
+			default:
+				if fname == arg {
+					files = append(files, fname)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Build the graph of the pages. Reverse links managed by htmlxref are left
+// out as they duplicate the forward links.
+func readGraph(args []string) (*Graph, error) {
+	files, err := walkFiles(args)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Graph{}
+	nodes := map[string]*Node{}
+	node := func(fname string) *Node {
+		id := filepath.ToSlash(relPath(fname))
+		n := nodes[id]
+		if n == nil {
+			n = &Node{Id: id}
+			nodes[id] = n
+			g.Nodes = append(g.Nodes, n)
+		}
+		return n
+	}
+
+	for _, fname := range files {
+		title, links, err := readDocument(fname)
+		if err != nil {
+			return nil, err
+		}
+
+		n := node(absPath(fname))
+		n.Title = title
+		n.Exists = true
+		for _, l := range links {
+			if l.Managed {
+				continue
+			}
+			g.Edges = append(g.Edges, Edge{
+				Source:    n.Id,
+				Target:    node(l.Target).Id,
+				Direction: l.Direction,
+				Kind:      l.Kind,
+			})
+		}
+	}
+
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Id < g.Nodes[j].Id })
+	return g, nil
+}
+
+func (g *Graph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	Id       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	Id          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	Id   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+func (g *Graph) WriteGraphML(w io.Writer) error {
+	doc := graphML{
+		Xmlns: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{"title", "node", "title", "string"},
+			{"exists", "node", "exists", "boolean"},
+			{"direction", "edge", "direction", "string"},
+			{"kind", "edge", "kind", "string"},
+		},
+		Graph: graphMLGraph{Id: "site", EdgeDefault: "directed"},
+	}
+	for _, n := range g.Nodes {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{n.Id, []graphMLData{
+			{"title", n.Title},
+			{"exists", fmt.Sprint(n.Exists)},
+		}})
+	}
+	for _, e := range g.Edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{e.Source, e.Target, []graphMLData{
+			{"direction", e.Direction},
+			{"kind", e.Kind},
+		}})
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(doc)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+func dotQuote(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return "\"" + s + "\""
+}
+
+// rev edges and pages outside the walked files are drawn dashed
+func (g *Graph) WriteDOT(w io.Writer) error {
+	_, err := fmt.Fprintln(w, "digraph site {")
+	if err != nil {
+		return err
+	}
+	for _, n := range g.Nodes {
+		label := n.Title
+		if label == "" {
+			label = n.Id
+		}
+		style := ""
+		if !n.Exists {
+			style = ", style=dashed"
+		}
+		_, err = fmt.Fprintf(w, "\t%s [label=%s, tooltip=%s%s];\n", dotQuote(n.Id), dotQuote(label), dotQuote(n.Id), style)
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range g.Edges {
+		style := ""
+		if e.Direction == "rev" {
+			style = ", style=dashed"
+		}
+		_, err = fmt.Fprintf(w, "\t%s -> %s [label=%s%s];\n", dotQuote(e.Source), dotQuote(e.Target), dotQuote(e.Direction+"="+e.Kind), style)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintln(w, "}")
+	return err
+}
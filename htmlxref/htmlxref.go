@@ -1,25 +1,82 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
+	"github.com/mildred/htmltools/atomicfile"
+	"github.com/mildred/htmltools/headedit"
+	"github.com/mildred/htmltools/udiff"
 	"golang.org/x/net/html"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
+// Attribute marking the reverse links managed by htmlxref, its value is the
+// origin of the forward link: "link" for <link> and "a" for <a rel> in the
+// body. Links marked by older versions have an empty origin.
+const managedAttr = "data-htmlxref"
+
+// rel values of <a> elements treated as forward links
+var anchorRels = map[string]bool{}
+
+func setAnchorRels(list string) {
+	for _, rel := range strings.Split(list, ",") {
+		if rel = strings.TrimSpace(rel); rel != "" {
+			anchorRels[rel] = true
+		}
+	}
+}
+
+// Where the progress messages are written, stderr when stdout contains the
+// diff
+var logOut io.Writer = os.Stdout
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "graph" {
+		err := graphMain(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	dryRun := flag.Bool("n", false, "Dry run, print the files that would change and the diff")
+	check := flag.Bool("check", false, "Do not modify files, exit with a non zero status if reverse links are missing or stale")
+	aRel := flag.String("a-rel", "", "Comma separated rel values of <a> elements in the body also treated as forward links")
 	flag.Parse()
-	fname := flag.Arg(0)
-	err := xref(fname)
+	setAnchorRels(*aRel)
+
+	if *dryRun || *check {
+		logOut = os.Stderr
+	}
+
+	changed, err := xref(flag.Args(), *dryRun || *check)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
+
+	for _, c := range changed {
+		if *dryRun {
+			fmt.Fprintf(os.Stderr, "Would change: %s\n", c.File)
+			err = udiff.Unified(os.Stdout, c.File, c.File, c.Old, c.New, 3)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if *check && len(changed) > 0 {
+		fmt.Fprintf(os.Stderr, "%d files with missing or stale reverse links\n", len(changed))
+		os.Exit(1)
+	}
 	os.Exit(0)
 }
 
@@ -41,6 +98,15 @@ func readAttributes(z *html.Tokenizer, attrs bool) (attributes [][]string, direc
 	return
 }
 
+func getAttribute(attributes [][]string, name string) (string, bool) {
+	for _, a := range attributes {
+		if a[0] == name {
+			return a[1], true
+		}
+	}
+	return "", false
+}
+
 func reverse(direction string) string {
 	switch direction {
 	case "rel":
@@ -52,184 +118,357 @@ func reverse(direction string) string {
 	}
 }
 
-func xref(fname string) error {
+// A <link rel|rev href> element, one per rel or rev token
+type Link struct {
+	Direction string
+	Kind      string
+	Href      string
+	Target    string // absolute path of the linked file
+	Managed   bool   // reverse link added by htmlxref
+	Origin    string // origin of the forward link of a managed link
+	Anchor    bool   // <a rel> in the body
+}
+
+// Origin recorded in the reverse link of l
+func (l Link) origin() string {
+	if l.Anchor {
+		return "a"
+	}
+	return "link"
+}
+
+// Return true if the current configuration creates the managed link l from
+// its forward link. Links without origin may come from <a rel> and are only
+// produced if their kind is in anchorRels.
+func (l Link) produced() bool {
+	if l.Origin == "link" {
+		return true
+	}
+	return anchorRels[l.Kind]
+}
+
+func absPath(fname string) string {
+	abs, err := filepath.Abs(fname)
+	if err != nil {
+		return filepath.Clean(fname)
+	}
+	return abs
+}
+
+// Read the <link> elements with rel or rev of a document
+func readLinks(fname string) ([]Link, error) {
+	_, links, err := readDocument(fname)
+	return links, err
+}
+
+// Read the title and the <link> elements with rel or rev of a document, and
+// the <a> elements whose rel is in anchorRels
+func readDocument(fname string) (title string, links []Link, err error) {
 	f, err := os.Open(fname)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 	defer f.Close()
 
+	inTitle := false
 	z := html.NewTokenizer(f)
 	z.AllowCDATA(true)
-
-	var breadcrumb []string
 	for {
 		tk := z.Next()
 		if tk == html.ErrorToken {
 			err := z.Err()
 			if err != io.EOF {
-				return err
+				return "", nil, err
 			}
-			break
+			return strings.TrimSpace(title), links, nil
 		}
-		//fmt.Printf("%v %v\n", tk, string(z.Raw()))
-		if tk == html.StartTagToken || tk == html.SelfClosingTagToken {
+		if tk == html.TextToken && inTitle {
+			title += string(z.Text())
+		} else if tk == html.EndTagToken {
+			tagName, _ := z.TagName()
+			if string(tagName) == "title" {
+				inTitle = false
+			}
+		} else if tk == html.StartTagToken || tk == html.SelfClosingTagToken {
 			tagName, attrs := z.TagName()
-			breadcrumb = append(breadcrumb, string(tagName))
-
-			if string(tagName) == "link" {
+			if string(tagName) == "title" && tk == html.StartTagToken && title == "" {
+				inTitle = true
+			} else if string(tagName) == "link" {
+				attributes, direction, kind, href := readAttributes(z, attrs)
+				target, ok := localTarget(fname, href)
+				if !ok || isResourceLink(kind) {
+					continue
+				}
+				origin, managed := getAttribute(attributes, managedAttr)
+				for _, rel := range strings.Fields(kind) {
+					links = append(links, Link{
+						Direction: direction,
+						Kind:      rel,
+						Href:      href,
+						Target:    target,
+						Managed:   managed,
+						Origin:    origin,
+					})
+				}
+			} else if string(tagName) == "a" && len(anchorRels) > 0 {
 				_, direction, kind, href := readAttributes(z, attrs)
-				fmt.Printf("Link: %v=%v %v\n", direction, kind, href)
-
-				if kind != "" {
-					target := filepath.Join(filepath.Dir(fname), href)
-					err := ensure_link(fname, target, reverse(direction), kind)
-					if err != nil && os.IsNotExist(err) {
-						fmt.Printf("      not modifiable\n")
-						err = nil
-					} else if err != nil {
-						return err
+				target, ok := localTarget(fname, href)
+				if direction != "rel" || !ok {
+					continue
+				}
+				for _, rel := range strings.Fields(kind) {
+					if anchorRels[rel] {
+						links = append(links, Link{
+							Direction: "rel",
+							Kind:      rel,
+							Href:      href,
+							Target:    target,
+							Anchor:    true,
+						})
 					}
 				}
 			}
 		}
-		if tk == html.EndTagToken || tk == html.SelfClosingTagToken {
-			breadcrumb = breadcrumb[:len(breadcrumb)-1]
+	}
+}
+
+// rel values of <link> elements pointing to resources instead of pages
+var resourceRels = map[string]bool{
+	"stylesheet":       true,
+	"icon":             true,
+	"apple-touch-icon": true,
+	"manifest":         true,
+	"preload":          true,
+	"modulepreload":    true,
+	"prefetch":         true,
+	"preconnect":       true,
+	"dns-prefetch":     true,
+}
+
+func isResourceLink(kind string) bool {
+	for _, rel := range strings.Fields(kind) {
+		if resourceRels[rel] {
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
-func ensure_link(target, source, direction, kind string) error {
-	f, err := os.Open(source)
-	if err != nil {
-		return err
+// Resolve a link to a local file, external URLs, absolute paths and
+// fragments or queries within the same page are not local.
+func localTarget(fname, href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+		return "", false
 	}
-	defer f.Close()
+	return absPath(filepath.Join(filepath.Dir(fname), u.Path)), true
+}
 
-	buf := bufio.NewReader(f)
-	line, err := buf.ReadString('\n')
-	if err != nil {
-		return err
+// A file modified by htmlxref
+type Change struct {
+	File string
+	Old  []byte
+	New  []byte
+}
+
+// Add the reverse links of the given files to the files they link to, and
+// remove the reverse links managed by htmlxref that have no forward link in
+// the given files any more. Files are left untouched if dryRun is true. The
+// changes are returned.
+func xref(fnames []string, dryRun bool) ([]Change, error) {
+	// desired reverse links per target file
+	desired := map[string][]Link{}
+	inSet := map[string]bool{}
+	var targets []string
+
+	for _, fname := range fnames {
+		source := absPath(fname)
+		inSet[source] = true
+		links, err := readLinks(fname)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, l := range links {
+			if l.Managed {
+				continue
+			}
+			if l.Anchor {
+				fmt.Fprintf(logOut, "Link: <a> %v=%v %v\n", l.Direction, l.Kind, l.Href)
+			} else {
+				fmt.Fprintf(logOut, "Link: %v=%v %v\n", l.Direction, l.Kind, l.Href)
+			}
+
+			ok, err := isHTMLFile(l.Target)
+			if err != nil && os.IsNotExist(err) {
+				fmt.Fprintf(logOut, "      not modifiable\n")
+				continue
+			} else if err != nil {
+				return nil, err
+			} else if !ok {
+				fmt.Fprintf(logOut, "      not a HTML file\n")
+				continue
+			}
+
+			if desired[l.Target] == nil {
+				targets = append(targets, l.Target)
+			}
+			desired[l.Target] = append(desired[l.Target], Link{
+				Direction: reverse(l.Direction),
+				Kind:      l.Kind,
+				Target:    source,
+				Managed:   true,
+				Origin:    l.origin(),
+			})
+		}
 	}
 
-	line = strings.ToLower(line)
-	if !strings.HasPrefix(line, "<!doctype") &&
-		!strings.HasPrefix(line, "<?xml") &&
-		!strings.HasPrefix(line, "<html") {
-		fmt.Printf("      not a HTML file\n")
-		return nil
+	for _, fname := range fnames {
+		if desired[absPath(fname)] == nil {
+			targets = append(targets, absPath(fname))
+		}
+	}
+	sort.Strings(targets)
+
+	var changes []Change
+	for _, target := range targets {
+		old, err := ioutil.ReadFile(target)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := updateLinks(target, old, desired[target], inSet)
+		if err != nil {
+			return nil, err
+		} else if data == nil {
+			continue
+		}
+
+		changes = append(changes, Change{relPath(target), old, data})
+		if !dryRun {
+			err = atomicfile.WriteFile(target, data)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
+	return changes, nil
+}
 
-	_, err = f.Seek(0, 0)
+// Path relative to the current directory if possible, for display
+func relPath(fname string) string {
+	cwd, err := os.Getwd()
 	if err != nil {
-		return err
+		return fname
 	}
+	rel, err := filepath.Rel(cwd, fname)
+	if err != nil {
+		return fname
+	}
+	return rel
+}
 
-	f2, err := ioutil.TempFile(filepath.Dir(source), filepath.Base(target))
+// Return true if the file is a HTML document with a head that can be edited
+func isHTMLFile(fname string) (bool, error) {
+	data, err := ioutil.ReadFile(fname)
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer f2.Close()
-	defer os.Remove(f2.Name())
+	return headedit.IsDocument(data), nil
+}
 
-	z := html.NewTokenizer(f)
-	var breadcrumb []string
-	var lastText string
-	for {
-		tk := z.Next()
-		raw0 := z.Raw()
-		rawData := make([]byte, len(raw0))
-		copy(rawData, raw0)
-		if tk == html.ErrorToken {
-			err := z.Err()
-			if err != io.EOF {
-				e := os.Remove(f2.Name())
-				if e != nil {
-					fmt.Fprintln(os.Stderr, e.Error())
-				}
-				return err
+// Ensure the desired links are in the file and remove the managed links that
+// point to a file of the set but are not desired any more. Returns the new
+// content of the file, or nil if nothing changes.
+func updateLinks(fname string, data []byte, want []Link, inSet map[string]bool) ([]byte, error) {
+	existing, err := readLinks(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var add []Link
+	for _, w := range want {
+		found := false
+		for _, e := range existing {
+			if !e.Anchor && w.Direction == e.Direction && w.Kind == e.Kind && samePath(w.Target, e.Target) {
+				found = true
+				break
 			}
-			break
 		}
-		if tk == html.StartTagToken || tk == html.SelfClosingTagToken {
-			tagName, attrs := z.TagName()
-			breadcrumb = append(breadcrumb, string(tagName))
-
-			if string(tagName) == "link" {
-				_, direction2, kind2, href := readAttributes(z, attrs)
-				target2 := filepath.Join(filepath.Dir(source), href)
-				//fmt.Printf("Link: %v\n", attributes)
+		if !found {
+			add = append(add, w)
+		}
+	}
 
-				if direction2 == direction && kind2 == kind && samePath(target, target2) {
-					// The link is already there
-					return os.Remove(f2.Name())
-				}
+	// origin of the desired link matching l, the <link> origin first
+	wanted := func(l Link) string {
+		origin := ""
+		for _, w := range want {
+			if w.Direction == l.Direction && w.Kind == l.Kind && samePath(w.Target, l.Target) && origin != "link" {
+				origin = w.Origin
 			}
 		}
-		if tk == html.TextToken {
-			lastText = string(z.Text())
+		return origin
+	}
+
+	// only the links the current configuration would create are removed
+	stale := func(l Link) bool {
+		if !l.Managed || !l.produced() {
+			return false
 		}
-		if tk == html.EndTagToken || tk == html.SelfClosingTagToken {
-			tagName, _ := z.TagName()
-			if string(tagName) == "head" {
-				href, err := filepath.Rel(filepath.Dir(source), target)
-				if err != nil {
-					e := os.Remove(f2.Name())
-					if e != nil {
-						fmt.Fprintln(os.Stderr, e.Error())
-					}
-					return err
-				}
-				indent := detectIndent(lastText, 1)
-				linkTag := fmt.Sprintf("%s<link %s=\"%s\" href=\"%s\" />\n%s",
-					indent,
-					direction, html.EscapeString(kind), html.EscapeString(href),
-					indent)
-				_, err = f2.Write([]byte(linkTag))
-				if err != nil {
-					e := os.Remove(f2.Name())
-					if e != nil {
-						fmt.Fprintln(os.Stderr, e.Error())
-					}
-					return err
-				}
-			}
+		if _, err := os.Stat(l.Target); err == nil && !inSet[l.Target] {
+			return false
+		}
+		return wanted(l) == ""
+	}
 
-			breadcrumb = breadcrumb[:len(breadcrumb)-1]
+	var elements []string
+	var changed int
+	for _, e := range existing {
+		if !e.Managed {
+			continue
+		} else if stale(e) {
+			fmt.Fprintf(logOut, "Remove: %s %v=%v %v\n", relPath(fname), e.Direction, e.Kind, e.Href)
+			changed++
+		} else {
+			if origin := wanted(e); origin != "" && origin != e.Origin {
+				e.Origin = origin
+				changed++
+			}
+			elements = append(elements, linkElement(e.Direction, e.Kind, e.Href, e.Origin))
 		}
+	}
+	if changed == 0 && len(add) == 0 {
+		return nil, nil
+	}
 
-		_, err = f2.Write(rawData)
+	for _, l := range add {
+		href, err := filepath.Rel(filepath.Dir(fname), l.Target)
 		if err != nil {
-			e := os.Remove(f2.Name())
-			if e != nil {
-				fmt.Fprintln(os.Stderr, e.Error())
-			}
-			return err
+			return nil, err
 		}
+		href = filepath.ToSlash(href)
+		fmt.Fprintf(logOut, "Add: %s %v=%v %v\n", relPath(fname), l.Direction, l.Kind, href)
+		elements = append(elements, linkElement(l.Direction, l.Kind, href, l.Origin))
 	}
 
-	return os.Rename(f2.Name(), f.Name())
+	return headedit.Update(data, func(t *html.Token) bool {
+		if t.Data != "link" {
+			return false
+		}
+		for _, a := range t.Attr {
+			if a.Key == managedAttr {
+				return true
+			}
+		}
+		return false
+	}, elements)
 }
 
-// FIXME: doesn't work with indent != 1
-func detectIndent(text string, indent int) string {
-	cr := strings.LastIndex(text, "\n")
-	if cr+1 >= len(text) {
-		return ""
-	}
-	if cr >= 0 {
-		text = text[cr+1:]
-	}
-	var block []byte
-	for i := 0; i < len(text) && len(block) <= len(text)/indent; i++ {
-		switch text[i] {
-		case ' ', '\t':
-			block = append(block, text[i])
-		default:
-		}
-	}
-	return string(block)
+// Serialize a managed link
+func linkElement(direction, kind, href, origin string) string {
+	return fmt.Sprintf("<link %s=\"%s\" href=\"%s\" %s=\"%s\" />",
+		direction, html.EscapeString(kind), html.EscapeString(href), managedAttr, origin)
 }
 
 func samePath(path1, path2 string) bool {
@@ -104,7 +104,7 @@ begin:
 		if r.avail < uint64(len(p)) {
 			p = p[:r.avail]
 		}
-		n, err := r.Read(p)
+		n, err := r.r.Read(p)
 		r.avail = r.avail - uint64(n)
 		return n, err
 	}
@@ -113,7 +113,7 @@ begin:
 
 func (r *Reader) readMode() error {
 	mode, err := readUvarint(r.r)
-	if err != nil {
+	if err == nil {
 		r.mode = Mode(mode)
 	}
 	return err
@@ -131,13 +131,14 @@ func (r *Reader) ReadSizedChunk() ([]byte, error) {
 }
 
 func NewWriter(w io.Writer) *Writer {
-	return &Writer{w, true, "", false}
+	return &Writer{w, true, "", false, false}
 }
 
 type Writer struct {
 	w     io.Writer
 	start bool
 	name  string
+	named bool
 	flat  bool
 }
 
@@ -155,45 +156,73 @@ func (w *Writer) SetFlat() {
 	w.start = false
 }
 
+// Write the stream header and the first file name if not already done
+func (w *Writer) begin() error {
+	if !w.start {
+		return nil
+	}
+	w.start = false
+	_, err := w.w.Write(header("/multifile"))
+	if err != nil {
+		return err
+	}
+	return w.WriteSizedChunk([]byte(w.name))
+}
+
+// End the current file
+func (w *Writer) end() error {
+	_, err := w.w.Write(appendUvarint(appendUvarint(nil, 0), uint64(ModeEOF)))
+	return err
+}
+
 func (w *Writer) Write(p []byte) (int, error) {
 	if w.flat {
 		return w.w.Write(p)
-	} else if w.start {
-		_, err := w.Write(header("/multifile"))
-		if err != nil {
-			return 0, err
-		}
-		w.start = false
-		err = w.WriteSizedChunk([]byte(w.name))
-		if err != nil {
-			return 0, err
-		}
+	}
+	err := w.begin()
+	if err != nil {
+		return 0, err
 	}
 	if len(p) == 0 {
 		return 0, nil
 	}
-	_, err := writeUvarint(w.w, uint64(len(p)))
+	_, err = writeUvarint(w.w, uint64(len(p)))
 	if err != nil {
 		return 0, err
 	}
-	return w.Write(p)
+	return w.w.Write(p)
 }
 
 func (w *Writer) Next(name string) error {
 	if w.flat {
 		return ErrNextOnFlatMode
-	} else if w.start {
+	} else if w.start && !w.named {
 		w.name = name
+		w.named = true
 		return nil
 	}
 
-	buf := appendUvarint(appendUvarint(nil, 0), uint64(ModeEOF))
-	buf = append(buf, []byte(name)...)
-	_, err := w.w.Write(buf)
+	err := w.begin()
 	if err != nil {
 		return err
 	}
-	return nil
+	err = w.end()
+	if err != nil {
+		return err
+	}
+	return w.WriteSizedChunk([]byte(name))
+}
+
+// End the last file of the stream
+func (w *Writer) Close() error {
+	if w.flat || (w.start && !w.named) {
+		return nil
+	}
+	err := w.begin()
+	if err != nil {
+		return err
+	}
+	return w.end()
 }
 
 func (w *Writer) WriteSizedChunk(buf []byte) error {
@@ -0,0 +1,123 @@
+package multifiles
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+type file struct {
+	name string
+	data string
+}
+
+// Write the files to a stream, the data of each file in several writes
+func writeFiles(t *testing.T, files []file, close bool) []byte {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, f := range files {
+		if err := w.Next(f.name); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(f.data); i += 3 {
+			end := i + 3
+			if end > len(f.data) {
+				end = len(f.data)
+			}
+			if _, err := w.Write([]byte(f.data[i:end])); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if close {
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func readFiles(t *testing.T, stream []byte) []file {
+	var files []file
+	r := NewReader(bytes.NewReader(stream), "dir/stream")
+	for {
+		err := r.Next()
+		if err == io.EOF {
+			return files
+		} else if err != nil {
+			t.Fatalf("after %v: %v", files, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %v", r.Name(), err)
+		}
+		files = append(files, file{r.Name(), string(data)})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		files []file
+	}{
+		{"none", nil},
+		{"one", []file{{"a.html", "<p>a</p>\n"}}},
+		{"several", []file{{"a.html", "hello"}, {"b.html", "<html>\n</html>\n"}, {"sub/c.html", "c"}}},
+		{"empty first", []file{{"a.html", ""}, {"b.html", "b"}}},
+		{"empty middle", []file{{"a.html", "a"}, {"b.html", ""}, {"c.html", "c"}}},
+		{"empty last", []file{{"a.html", "a"}, {"b.html", ""}}},
+	} {
+		for _, close := range []bool{true, false} {
+			stream := writeFiles(t, c.files, close)
+			files := readFiles(t, stream)
+			if !reflect.DeepEqual(files, c.files) {
+				t.Errorf("%s (close %v): got %q, want %q", c.name, close, files, c.files)
+			}
+		}
+	}
+}
+
+// Nothing is written before the first write, Close is needed to write a lone
+// empty file
+func TestRoundTripEmptyFile(t *testing.T) {
+	want := []file{{"a.html", ""}}
+	if files := readFiles(t, writeFiles(t, want, true)); !reflect.DeepEqual(files, want) {
+		t.Errorf("got %q, want %q", files, want)
+	}
+	if stream := writeFiles(t, want, false); len(stream) != 0 {
+		t.Errorf("got %q without Close, want nothing", stream)
+	}
+}
+
+func TestReaderFileName(t *testing.T) {
+	stream := writeFiles(t, []file{{"page-2.html", "2"}}, true)
+	r := NewReader(bytes.NewReader(stream), "dir/index.html")
+	if err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Mode() != ModeSize {
+		t.Errorf("got mode %d, want %d", r.Mode(), ModeSize)
+	}
+	if name := r.FileName(); name != "dir/page-2.html" {
+		t.Errorf("got file name %q, want %q", name, "dir/page-2.html")
+	}
+}
+
+// A file left unread is skipped by Next
+func TestReaderSkip(t *testing.T) {
+	stream := writeFiles(t, []file{{"a.html", "aaaa"}, {"b.html", "bbbb"}}, true)
+	r := NewReader(bytes.NewReader(stream), "stream")
+	for _, want := range []string{"a.html", "b.html"} {
+		if err := r.Next(); err != nil {
+			t.Fatal(err)
+		}
+		if r.Name() != want {
+			t.Errorf("got %q, want %q", r.Name(), want)
+		}
+	}
+	if err := r.Next(); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
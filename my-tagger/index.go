@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mildred/htmltools/atomicfile"
+	"github.com/mildred/htmltools/headedit"
+	"github.com/mildred/htmltools/parser"
+	"golang.org/x/net/html"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A tag and the pages tagged with it
+type TagIndex struct {
+	Name  string
+	File  string // tag page, target of the <link rel="tag">
+	Pages []TaggedPage
+}
+
+type TaggedPage struct {
+	Title string
+	File  string
+}
+
+// Scan a tree for <link rel="tag"> and write a page per tag, and optionally a
+// page with all the tags. The pages are html-template documents made from the
+// layouts, their data is written next to them in a JSON file used as src of
+// the <template-instance data-my-tagger> of the layout. A generator <meta> or
+// member marks the files owned by my-tagger, other existing files are not
+// overwritten.
+func indexMain(args []string) error {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	layout := flags.String("layout", "", "Layout of the tag pages (html-template document)")
+	all := flags.String("all", "", "Write the page listing all the tags to this file")
+	allLayout := flags.String("all-layout", "", "Layout of the page listing all the tags (html-template document)")
+	rel := flags.String("rel", "tag", "rel of the <link> elements giving the tags")
+	root := flags.String("root", ".", "Site root used to resolve absolute tag links")
+	flags.Parse(args)
+
+	if *layout == "" {
+		return fmt.Errorf("Missing -layout")
+	} else if *all != "" && *allLayout == "" {
+		return fmt.Errorf("Missing -all-layout")
+	}
+
+	dirs := flags.Args()
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+
+	tags, err := scanTags(dirs, *rel, *root)
+	if err != nil {
+		return err
+	}
+
+	tagLayout, err := ioutil.ReadFile(*layout)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		data := tagData{Generator: generator, Name: tag.Name, Count: len(tag.Pages)}
+		for _, page := range tag.Pages {
+			data.Page = append(data.Page, pageData{page.Title, relHref(tag.File, page.File)})
+		}
+		err = writeIndex(tag.File, tagLayout, data, fmt.Sprintf("%d pages", len(tag.Pages)))
+		if err != nil {
+			return fmt.Errorf("%s: %v", *layout, err)
+		}
+	}
+
+	if *all == "" {
+		return nil
+	}
+
+	allData, err := ioutil.ReadFile(*allLayout)
+	if err != nil {
+		return err
+	}
+
+	min, max := -1, 0
+	for _, tag := range tags {
+		if min < 0 || len(tag.Pages) < min {
+			min = len(tag.Pages)
+		}
+		if len(tag.Pages) > max {
+			max = len(tag.Pages)
+		}
+	}
+
+	data := allTagsData{Generator: generator, Count: len(tags)}
+	for _, tag := range tags {
+		weight := 1
+		if max > min {
+			weight = 1 + 9*(len(tag.Pages)-min)/(max-min)
+		}
+		data.Tag = append(data.Tag, tagCloudData{tag.Name, relHref(*all, tag.File), len(tag.Pages), weight})
+	}
+
+	err = writeIndex(*all, allData, data, fmt.Sprintf("%d tags", len(tags)))
+	if err != nil {
+		return fmt.Errorf("%s: %v", *allLayout, err)
+	}
+	return nil
+}
+
+// Data of a tag page, /data/name, /data/count and /data/page in html-template
+type tagData struct {
+	Generator string     `json:"generator"`
+	Name      string     `json:"name"`
+	Count     int        `json:"count"`
+	Page      []pageData `json:"page"`
+}
+
+type pageData struct {
+	Title string `json:"title"`
+	Href  string `json:"href"`
+}
+
+// Data of the page listing all the tags, /data/count and /data/tag in
+// html-template
+type allTagsData struct {
+	Generator string         `json:"generator"`
+	Count     int            `json:"count"`
+	Tag       []tagCloudData `json:"tag"`
+}
+
+type tagCloudData struct {
+	Name   string `json:"name"`
+	Href   string `json:"href"`
+	Count  int    `json:"count"`
+	Weight int    `json:"weight"` // 1 to 10, for a tag cloud
+}
+
+// Walk the directories for HTML pages and aggregate them by tag
+func scanTags(dirs []string, rel, root string) ([]*TagIndex, error) {
+	index := map[string]*TagIndex{}
+	var tags []*TagIndex
+
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(fname string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			switch strings.ToLower(filepath.Ext(fname)) {
+			case ".html", ".htm", ".xhtml":
+			default:
+				return nil
+			}
+			if info.IsDir() {
+				return nil
+			}
+
+			f, err := os.Open(fname)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			title, links, err := readTagLinks(f, rel)
+			if err != nil {
+				return fmt.Errorf("%s: %v", fname, err)
+			}
+
+			for _, l := range links {
+				u, err := url.Parse(l.Link)
+				if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+					continue
+				}
+				file := filepath.Join(filepath.Dir(fname), filepath.FromSlash(u.Path))
+				if strings.HasPrefix(u.Path, "/") {
+					file = filepath.Join(root, filepath.FromSlash(u.Path))
+				}
+
+				tag := index[file]
+				if tag == nil {
+					tag = &TagIndex{File: file}
+					index[file] = tag
+					tags = append(tags, tag)
+				}
+				if tag.Name == "" {
+					tag.Name = l.Name
+				}
+				tag.Pages = append(tag.Pages, TaggedPage{title, fname})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, tag := range tags {
+		if tag.Name == "" {
+			tag.Name = strings.TrimSuffix(filepath.Base(tag.File), filepath.Ext(tag.File))
+		}
+		sort.SliceStable(tag.Pages, func(i, j int) bool {
+			return tag.Pages[i].Title < tag.Pages[j].Title
+		})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return strings.ToLower(tags[i].Name) < strings.ToLower(tags[j].Name)
+	})
+	return tags, nil
+}
+
+// Read the title and the <link rel> of a page
+func readTagLinks(r io.Reader, rel string) (string, []Tag, error) {
+	var title string
+	var links []Tag
+	p := parser.NewParser(r)
+	for {
+		err := p.Next()
+		if err == io.EOF {
+			return title, links, nil
+		} else if err != nil {
+			return "", nil, err
+		}
+
+		if p.Type() == html.StartTagToken && p.Data() == "title" && title == "" {
+			data, err := p.TextContent()
+			if err != nil {
+				return "", nil, err
+			}
+			title = strings.TrimSpace(string(data))
+		} else if p.IsStartTag() && p.Data() == "link" && hasRel(p.Token(), rel) {
+			links = append(links, Tag{
+				Name: p.AttrVal("title", ""),
+				Link: p.AttrVal("href", ""),
+			})
+		} else if p.IsEndTag() && p.Data() == "head" {
+			return title, links, nil
+		}
+	}
+}
+
+// Link from the page at from to the file target
+func relHref(from, target string) string {
+	href, err := filepath.Rel(filepath.Dir(from), target)
+	if err != nil {
+		return filepath.ToSlash(target)
+	}
+	return filepath.ToSlash(href)
+}
+
+// Name of the generator marking the pages and data files written by my-tagger
+const generator = "my-tagger"
+
+// Attribute of the <template-instance> elements of a layout using the data
+const dataAttr = "data-my-tagger"
+
+// Data file of a page, next to it
+func dataFile(fname string) string {
+	return strings.TrimSuffix(fname, filepath.Ext(fname)) + ".json"
+}
+
+// Make a page from a layout: the <template-instance data-my-tagger> elements
+// get the data file as src, and the generator <meta> is added to the head
+func renderLayout(layout []byte, src string) ([]byte, error) {
+	var out []byte
+	found := false
+	p := parser.NewParser(bytes.NewReader(layout))
+	for {
+		err := p.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if p.IsStartTag() && p.Data() == "template-instance" && p.Attr(dataAttr) != nil {
+			out = append(out, "<template-instance"...)
+			for _, a := range p.Token().Attr {
+				if a.Key != "src" && a.Key != dataAttr {
+					out = append(out, fmt.Sprintf(" %s=\"%s\"", a.Key, html.EscapeString(a.Val))...)
+				}
+			}
+			out = append(out, fmt.Sprintf(" src=\"%s\"", html.EscapeString(src))...)
+			if p.Type() == html.SelfClosingTagToken {
+				out = append(out, " />"...)
+			} else {
+				out = append(out, '>')
+			}
+			found = true
+			continue
+		}
+		out = append(out, p.Raw()...)
+	}
+	if !found {
+		return nil, fmt.Errorf("No <template-instance %s> in layout", dataAttr)
+	}
+
+	return headedit.Update(out, isGenerator, []string{
+		fmt.Sprintf("<meta name=\"generator\" content=\"%s\" />", generator),
+	})
+}
+
+func isGenerator(t *html.Token) bool {
+	return t.Data == "meta" && parser.Attr(t, "name") != nil && parser.Attr(t, "name").Val == "generator"
+}
+
+// Return true if the page does not exist or was written by my-tagger
+func ownsPage(fname string) (bool, error) {
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	p := parser.NewParser(f)
+	for {
+		err := p.Next()
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		if p.IsStartTag() && isGenerator(p.Token()) {
+			return p.AttrVal("content", "") == generator, nil
+		} else if p.IsEndTag() && p.Data() == "head" {
+			return false, nil
+		}
+	}
+}
+
+// Return true if the data file does not exist or was written by my-tagger
+func ownsData(fname string) (bool, error) {
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	var v struct {
+		Generator string `json:"generator"`
+	}
+	return json.Unmarshal(data, &v) == nil && v.Generator == generator, nil
+}
+
+// Write the page fname from the layout and its data file, unless one of them
+// was not written by my-tagger
+func writeIndex(fname string, layout []byte, data interface{}, what string) error {
+	datafile := dataFile(fname)
+	for _, owns := range []struct {
+		fname string
+		owns  func(string) (bool, error)
+	}{{fname, ownsPage}, {datafile, ownsData}} {
+		owned, err := owns.owns(owns.fname)
+		if err != nil {
+			return err
+		} else if !owned {
+			fmt.Fprintf(os.Stderr, "skip %s: %s not generated by my-tagger\n", fname, owns.fname)
+			return nil
+		}
+	}
+
+	page, err := renderLayout(layout, filepath.Base(datafile))
+	if err != nil {
+		return err
+	}
+	js, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "write %s (%s)\n", fname, what)
+	err = os.MkdirAll(filepath.Dir(fname), 0777)
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(datafile, append(js, '\n'))
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(fname, page)
+}
@@ -1,18 +1,50 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"github.com/mildred/htmltools/atomicfile"
+	"github.com/mildred/htmltools/headedit"
 	"github.com/mildred/htmltools/parser"
 	"golang.org/x/net/html"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 )
 
+// Attribute marking the <link> elements managed by my-tagger
+const managedAttr = "data-my-tagger"
+
+// How tags are discovered and written
+type Config struct {
+	Scope    []Selector // elements containing the tags, the whole document if not found
+	Select   []Selector // elements giving a tag
+	Rel      string     // rel of the <link> elements written in the head
+	Title    string     // tag title source: text, html or attr:NAME
+	Keywords string     // href pattern for <meta name="keywords">, %s is the keyword
+	Prune    bool       // remove managed <link> elements without tag
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "index" {
+		err := indexMain(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	var config Config
+	scope := flag.String("scope", "div#content", "Selectors of the elements containing the tags")
+	selectors := flag.String("select", "a.tag, a[rel~=tag]", "Selectors of the elements giving a tag (with href)")
+	flag.StringVar(&config.Rel, "rel", "tag", "rel of the <link> elements added to the head")
+	flag.StringVar(&config.Title, "title", "text", "Tag title: text content (text), inner HTML (html) or attribute (attr:NAME)")
+	flag.StringVar(&config.Keywords, "keywords", "", "Also read tags from <meta name=\"keywords\">, with this href pattern (e.g. /tags/%s.html)")
+	flag.BoolVar(&config.Prune, "prune", true, "Remove the <link> elements added by my-tagger whose tag disappeared")
 	flag.Parse()
 	infile := flag.Arg(0)
 
@@ -20,7 +52,17 @@ func main() {
 		infile = ""
 	}
 
-	err := main2(infile)
+	var err error
+	config.Scope, err = ParseSelectors(*scope)
+	if err == nil {
+		config.Select, err = ParseSelectors(*selectors)
+	}
+	if err == nil && config.Title != "text" && config.Title != "html" && !strings.HasPrefix(config.Title, "attr:") {
+		err = fmt.Errorf("Invalid -title %#v, expected text, html or attr:NAME", config.Title)
+	}
+	if err == nil {
+		err = main2(infile, config)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
@@ -29,57 +71,34 @@ func main() {
 	os.Exit(0)
 }
 
-func main2(infile string) error {
-	var r io.ReadSeeker
-	var w io.Writer
-	var outfile string
+func main2(infile string, config Config) error {
 	if infile == "" {
 		return fmt.Errorf("Expected filename on command line")
-	} else {
-		fmt.Fprintf(os.Stderr, "Read %s\n", infile)
-
-		f, err := os.Open(infile)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		r = f
+	}
 
-		fw, err := ioutil.TempFile(filepath.Dir(infile), filepath.Base(infile))
-		if err != nil {
-			return err
-		}
-		defer fw.Close()
-		w = fw
-		outfile = fw.Name()
+	fmt.Fprintf(os.Stderr, "Read %s\n", infile)
+	data, err := ioutil.ReadFile(infile)
+	if err != nil {
+		return err
 	}
 
-	tags, err := getTags(r)
+	tags, err := getTags(bytes.NewReader(data), config)
 	if err != nil && err != io.EOF {
 		return fmt.Errorf("While parsing tags: %v", err)
 	}
 
 	fmt.Fprintf(os.Stderr, "detect %d tags\n", len(tags))
 
-	_, err = r.Seek(0, 0)
+	res, err := handleTags(data, tags, config)
 	if err != nil {
-		return err
-	}
-
-	p := parser.NewParser(r)
-	err = handleTags(p, w, tags)
-	if err != nil && err != io.EOF {
 		return fmt.Errorf("While adding tags: %v", err)
 	}
 
-	if infile != "" {
-		err := os.Rename(outfile, infile)
-		if err != nil {
-			return err
-		}
+	if bytes.Equal(res, data) {
+		return nil
 	}
 
-	return nil
+	return atomicfile.WriteFile(infile, res)
 }
 
 type Tag struct {
@@ -87,99 +106,190 @@ type Tag struct {
 	Link string
 }
 
-func getTags(r io.Reader) ([]Tag, error) {
-	var res []Tag
+func getTags(r io.Reader, config Config) ([]Tag, error) {
+	var res, scoped []Tag
+	var scopeDepth int
+	var inScope bool
 
 	p := parser.NewParser(r)
 	for {
 
 		err := p.Next()
-		if err != nil {
-			return res, err
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if scopeDepth > 0 && p.Depth() < scopeDepth {
+			scopeDepth = 0
 		}
 
-		if p.IsStartTag() && p.Data() == "div" && p.AttrVal("id", "") == "content" {
-			res = nil
+		if p.Type() == html.StartTagToken && scopeDepth == 0 && matchAny(config.Scope, p.Token()) {
+			scopeDepth = p.Depth()
+			inScope = true
+			continue
 		}
 
-		if p.IsStartTag() && p.Data() == "a" && p.AttrVal("class", "") == "tag" {
+		if config.Keywords != "" && p.IsStartTag() && p.Data() == "meta" && strings.ToLower(p.AttrVal("name", "")) == "keywords" {
+			for _, kw := range strings.Split(p.AttrVal("content", ""), ",") {
+				if kw = strings.TrimSpace(kw); kw != "" {
+					href := strings.Replace(config.Keywords, "%s", keywordSlug(kw), -1)
+					fmt.Fprintf(os.Stderr, "detect %s %s\n", kw, href)
+					res = append(res, Tag{Name: kw, Link: href})
+					scoped = append(scoped, Tag{Name: kw, Link: href})
+				}
+			}
+			continue
+		}
+
+		if p.IsStartTag() && matchAny(config.Select, p.Token()) {
 			href := p.AttrVal("href", "")
-			data, err := p.RawContent()
-			if err != nil {
-				return nil, err
+			var name string
+			if strings.HasPrefix(config.Title, "attr:") {
+				name = p.AttrVal(strings.TrimPrefix(config.Title, "attr:"), "")
+			} else if config.Title == "html" {
+				data, err := p.RawContent()
+				if err != nil {
+					return nil, err
+				}
+				name = string(data)
+			} else {
+				data, err := p.TextContent()
+				if err != nil {
+					return nil, err
+				}
+				name = strings.Join(strings.Fields(string(data)), " ")
+			}
+			if href == "" {
+				continue
 			}
-			fmt.Fprintf(os.Stderr, "detect %s %s\n", string(data), href)
+			fmt.Fprintf(os.Stderr, "detect %s %s\n", name, href)
 			res = append(res, Tag{
-				Name: string(data),
+				Name: name,
 				Link: href,
 			})
+			if scopeDepth > 0 {
+				scoped = append(scoped, res[len(res)-1])
+			}
 		}
 	}
-}
 
-func handleTags(p *parser.Parser, w io.Writer, tags []Tag) error {
-	last_text := ""
+	if inScope {
+		return scoped, nil
+	}
+	return res, nil
+}
 
-	for {
+// Keyword as used in the href pattern
+func keywordSlug(kw string) string {
+	return url.PathEscape(strings.ToLower(strings.Join(strings.Fields(kw), "-")))
+}
 
-		err := p.Next()
-		if err != nil {
-			return err
+// Return true if the token has the rel token among its space separated rel
+// values
+func hasRel(t *html.Token, rel string) bool {
+	a := parser.Attr(t, "rel")
+	if a == nil {
+		return false
+	}
+	for _, r := range strings.Fields(a.Val) {
+		if r == rel {
+			return true
 		}
+	}
+	return false
+}
 
-		data := p.Raw()
-
-		if p.Type() == html.TextToken {
-			last_text = string(p.Data())
+// Write a <link> in the head for each tag, and remove the ones without tag.
+// Only the links marked with managedAttr are rewritten or removed. Unmarked
+// links, written by hand or by older versions, are adopted and marked if a tag
+// points to them, the other ones are left untouched.
+func handleTags(data []byte, tags []Tag, config Config) ([]byte, error) {
+	var elements []string
+	seen := map[string]bool{}
+	adopted := map[string]bool{}
+	exists := map[string][]html.Attribute{}
+	p := parser.NewParser(bytes.NewReader(data))
+	for {
+		err := p.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
 		}
 
-		if p.IsStartTag() && p.Data() == "link" && p.AttrVal("rel", "") == "tag" {
+		if p.IsStartTag() && p.Data() == "link" && hasRel(p.Token(), config.Rel) {
 			href := p.AttrVal("href", "")
-			for i := range tags {
-				if tags[i].Link == href {
-					fmt.Fprintf(os.Stderr, "exists: %s %s\n", tags[i].Name, tags[i].Link)
-					tags[i].Link = ""
+			exists[href] = p.Token().Attr
+			found := false
+			for _, tag := range tags {
+				if tag.Link == href {
+					fmt.Fprintf(os.Stderr, "exists: %s %s\n", tag.Name, tag.Link)
+					found = true
 				}
 			}
-		} else if p.IsEndTag() && p.Data() == "head" {
-			indent := detectIndent(last_text, 1)
-			for _, tag := range tags {
-				if tag.Link == "" {
-					continue
+			if p.Attr(managedAttr) == nil {
+				if found {
+					adopted[href] = true
+				} else {
+					seen[href] = true
 				}
-				fmt.Fprintf(os.Stderr, "add: %s %s\n", tag.Name, tag.Link)
-				tag := fmt.Sprintf("%s<link rel=\"tag\" href=\"%s\" title=\"%s\" />\n%s",
-					indent,
-					html.EscapeString(tag.Link),
-					html.EscapeString(tag.Name),
-					indent)
-				data = append([]byte(tag), data...)
+				continue
+			}
+			if !found && config.Prune {
+				fmt.Fprintf(os.Stderr, "remove: %s\n", href)
+			} else if !found {
+				elements = append(elements, tagElement(p.Token().Attr, config.Rel, href, nil))
 			}
 		}
+	}
 
-		_, err = w.Write(data)
-		if err != nil {
-			return err
+	for _, tag := range tags {
+		if seen[tag.Link] {
+			continue
 		}
+		seen[tag.Link] = true
+		if exists[tag.Link] == nil {
+			fmt.Fprintf(os.Stderr, "add: %s %s\n", tag.Name, tag.Link)
+		}
+		var title *html.Attribute
+		if tag.Name != "" {
+			title = &html.Attribute{Key: "title", Val: tag.Name}
+		}
+		elements = append(elements, tagElement(exists[tag.Link], config.Rel, tag.Link, title))
 	}
+
+	return headedit.Update(data, func(t *html.Token) bool {
+		if t.Data != "link" || !hasRel(t, config.Rel) {
+			return false
+		}
+		href := parser.Attr(t, "href")
+		return parser.Attr(t, managedAttr) != nil || (href != nil && adopted[href.Val])
+	}, elements)
 }
 
-// FIXME: doesn't work with indent != 1
-func detectIndent(text string, indent int) string {
-	cr := strings.LastIndex(text, "\n")
-	if cr+1 >= len(text) {
-		return ""
-	}
-	if cr >= 0 {
-		text = text[cr+1:]
-	}
-	var block []byte
-	for i := 0; i < len(text) && len(block) <= len(text)/indent; i++ {
-		switch text[i] {
-		case ' ', '\t':
-			block = append(block, text[i])
-		default:
+// Serialize a tag <link>, keeping the attributes of the existing element if
+// any, replacing its title if one is given and marking it with managedAttr
+func tagElement(attrs []html.Attribute, rel, href string, title *html.Attribute) string {
+	if attrs == nil {
+		attrs = []html.Attribute{{Key: "rel", Val: rel}, {Key: "href", Val: href}}
+	}
+	res := "<link"
+	hasTitle, managed := false, false
+	for _, a := range attrs {
+		if a.Key == "title" && title != nil {
+			a.Val = title.Val
+			hasTitle = true
 		}
+		managed = managed || a.Key == managedAttr
+		res += fmt.Sprintf(" %s=\"%s\"", a.Key, html.EscapeString(a.Val))
+	}
+	if !managed {
+		res += fmt.Sprintf(" %s=\"\"", managedAttr)
+	}
+	if title != nil && !hasTitle {
+		res += fmt.Sprintf(" title=\"%s\"", html.EscapeString(title.Val))
 	}
-	return string(block)
+	return res + " />"
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/html"
+	"strings"
+)
+
+// Simple CSS selector: tag, .class, #id, [attr], [attr=val] and [attr~=val]
+// without combinators
+type Selector struct {
+	Tag     string
+	Id      string
+	Classes []string
+	Attrs   []AttrSelector
+}
+
+type AttrSelector struct {
+	Name string
+	Op   string // "", "=" or "~="
+	Val  string
+}
+
+func isIdentChar(c byte) bool {
+	return c == '-' || c == '_' || c == ':' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func readIdent(s string) (string, string) {
+	i := 0
+	for i < len(s) && isIdentChar(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// Parse a comma separated list of selectors, an empty string gives no
+// selector
+func ParseSelectors(s string) ([]Selector, error) {
+	var res []Selector
+	for _, src := range strings.Split(s, ",") {
+		src = strings.TrimSpace(src)
+		if src == "" {
+			continue
+		}
+		sel, err := parseSelector(src)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, sel)
+	}
+	return res, nil
+}
+
+func parseSelector(src string) (Selector, error) {
+	var sel Selector
+	var ident string
+	s := src
+	if strings.HasPrefix(s, "*") {
+		s = s[1:]
+	} else {
+		sel.Tag, s = readIdent(s)
+		sel.Tag = strings.ToLower(sel.Tag)
+	}
+
+	for s != "" {
+		switch s[0] {
+		case '.':
+			ident, s = readIdent(s[1:])
+			sel.Classes = append(sel.Classes, ident)
+		case '#':
+			ident, s = readIdent(s[1:])
+			sel.Id = ident
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return sel, fmt.Errorf("Invalid selector %#v: missing ]", src)
+			}
+			var a AttrSelector
+			expr := s[1:end]
+			s = s[end+1:]
+			if i := strings.Index(expr, "~="); i >= 0 {
+				a = AttrSelector{expr[:i], "~=", expr[i+2:]}
+			} else if i := strings.Index(expr, "="); i >= 0 {
+				a = AttrSelector{expr[:i], "=", expr[i+1:]}
+			} else {
+				a = AttrSelector{Name: expr}
+			}
+			a.Name = strings.ToLower(strings.TrimSpace(a.Name))
+			a.Val = strings.Trim(strings.TrimSpace(a.Val), "\"'")
+			sel.Attrs = append(sel.Attrs, a)
+			continue
+		default:
+			return sel, fmt.Errorf("Invalid selector %#v", src)
+		}
+		if ident == "" {
+			return sel, fmt.Errorf("Invalid selector %#v", src)
+		}
+	}
+	return sel, nil
+}
+
+func tokenAttr(t *html.Token, name string) (string, bool) {
+	for _, a := range t.Attr {
+		if a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func hasToken(list, tok string) bool {
+	for _, t := range strings.Fields(list) {
+		if t == tok {
+			return true
+		}
+	}
+	return false
+}
+
+func (sel Selector) Match(t *html.Token) bool {
+	if sel.Tag != "" && sel.Tag != t.Data {
+		return false
+	}
+	if sel.Id != "" {
+		if id, _ := tokenAttr(t, "id"); id != sel.Id {
+			return false
+		}
+	}
+	class, _ := tokenAttr(t, "class")
+	for _, c := range sel.Classes {
+		if !hasToken(class, c) {
+			return false
+		}
+	}
+	for _, a := range sel.Attrs {
+		val, ok := tokenAttr(t, a.Name)
+		switch {
+		case !ok:
+			return false
+		case a.Op == "=" && val != a.Val:
+			return false
+		case a.Op == "~=" && !hasToken(val, a.Val):
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(sels []Selector, t *html.Token) bool {
+	for _, sel := range sels {
+		if sel.Match(t) {
+			return true
+		}
+	}
+	return false
+}
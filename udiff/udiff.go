@@ -0,0 +1,196 @@
+package udiff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+type Op byte
+
+const (
+	OpEqual  Op = ' '
+	OpDelete Op = '-'
+	OpInsert Op = '+'
+)
+
+type Edit struct {
+	Op   Op
+	Line string // including the trailing newline, if any
+}
+
+// Split data in lines, keeping the newline characters
+func Lines(data []byte) []string {
+	var res []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			i = len(data) - 1
+		}
+		res = append(res, string(data[:i+1]))
+		data = data[i+1:]
+	}
+	return res
+}
+
+// Compute the shortest edit script from a to b (Myers algorithm)
+func Diff(a, b []string) []Edit {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+search:
+	for d := 0; d <= max; d++ {
+		vc := make([]int, len(v))
+		copy(vc, v)
+		trace = append(trace, vc)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	var edits []Edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			edits = append(edits, Edit{OpEqual, a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, Edit{OpInsert, b[y-1]})
+				y--
+			} else {
+				edits = append(edits, Edit{OpDelete, a[x-1]})
+				x--
+			}
+		}
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// Write an unified diff from a to b with the given number of context lines.
+// Nothing is written if a and b are identical.
+func Unified(w io.Writer, fromName, toName string, a, b []byte, context int) error {
+	edits := Diff(Lines(a), Lines(b))
+
+	var changed bool
+	for _, e := range edits {
+		if e.Op != OpEqual {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", fromName, toName)
+	if err != nil {
+		return err
+	}
+
+	// line numbers in a and b before each edit
+	lineA := make([]int, len(edits)+1)
+	lineB := make([]int, len(edits)+1)
+	for i, e := range edits {
+		lineA[i+1] = lineA[i]
+		lineB[i+1] = lineB[i]
+		if e.Op != OpInsert {
+			lineA[i+1]++
+		}
+		if e.Op != OpDelete {
+			lineB[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		if edits[i].Op == OpEqual {
+			i++
+			continue
+		}
+
+		// Extend the hunk while changes are close enough
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].Op != OpEqual {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		stop := end + context
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+
+		err = writeHunk(w, edits[start:stop], lineA[start], lineB[start], lineA[stop]-lineA[start], lineB[stop]-lineB[start])
+		if err != nil {
+			return err
+		}
+		i = stop
+	}
+	return nil
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	} else if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func writeHunk(w io.Writer, edits []Edit, startA, startB, countA, countB int) error {
+	_, err := fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(startA, countA), hunkRange(startB, countB))
+	if err != nil {
+		return err
+	}
+	for _, e := range edits {
+		line := e.Line
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			line += "\n\\ No newline at end of file\n"
+		}
+		_, err = fmt.Fprintf(w, "%c%s", e.Op, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
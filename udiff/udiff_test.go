@@ -0,0 +1,64 @@
+package udiff
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func editString(edits []Edit) string {
+	var res []string
+	for _, e := range edits {
+		res = append(res, string(e.Op)+strings.TrimSuffix(e.Line, "\n"))
+	}
+	return strings.Join(res, ",")
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"", "", ""},
+		{"a\n", "a\n", " a"},
+		{"", "a\nb\n", "+a,+b"},
+		{"a\nb\n", "", "-a,-b"},
+		{"a\nc\n", "a\nb\nc\n", " a,+b, c"},
+		{"a\nb\nc\n", "a\nc\n", " a,-b, c"},
+		{"a\nb\nc\n", "a\nx\nc\n", " a,-b,+x, c"},
+		{"a\nb", "a\nb\n", " a,-b,+b"},
+	}
+	for _, test := range tests {
+		got := editString(Diff(Lines([]byte(test.a)), Lines([]byte(test.b))))
+		if got != test.want {
+			t.Errorf("Diff(%q, %q) = %q, want %q", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"", "", ""},
+		{"a\nb\n", "a\nb\n", ""},
+		{"", "a\n", "--- x\n+++ y\n@@ -0,0 +1 @@\n+a\n"},
+		{"a\n", "", "--- x\n+++ y\n@@ -1 +0,0 @@\n-a\n"},
+		{"1\n2\n3\n4\n5\n6\n7\n", "1\n2\n3\n4\nnew\n5\n6\n7\n",
+			"--- x\n+++ y\n@@ -4,2 +4,3 @@\n 4\n+new\n 5\n"},
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n", "2\n3\n4\n5\n6\n7\n8\n",
+			"--- x\n+++ y\n@@ -1,2 +1 @@\n-1\n 2\n@@ -8,2 +7 @@\n 8\n-9\n"},
+		{"a", "b", "--- x\n+++ y\n@@ -1 +1 @@\n-a\n\\ No newline at end of file\n+b\n\\ No newline at end of file\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := Unified(&buf, "x", "y", []byte(test.a), []byte(test.b), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("Unified(%q, %q):\n%s\nwant:\n%s", test.a, test.b, buf.String(), test.want)
+		}
+	}
+}